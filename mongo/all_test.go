@@ -6,7 +6,11 @@ package mongo
 
 import (
 	"testing"
+	"container/vector"
 	"fmt"
+	"net"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -78,6 +82,488 @@ func TestOtherStuff(t *testing.T) {
 
 }
 
+func TestInsertAssignsId(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("ids")
+	coll.Drop()
+
+	doc, _ := Marshal(map[string]string{"name": "no id"})
+	id, err := coll.Insert(doc)
+	assertTrue(err == nil && id.Kind() == OIDKind, fmt.Sprintf("insert gave id %v, %v", id, err), t)
+	assertTrue(doc.Get("_id").Kind() == NullKind, "insert changed the document", t)
+
+	q, _ := Marshal(Doc{{"_id", ObjectId(id.OID())}})
+	count, _ := coll.Count(q)
+	assertTrue(count == 1, "no document with the returned id", t)
+
+	doc, _ = Marshal(map[string]string{"_id": "mine"})
+	id, err = coll.Insert(doc)
+	assertTrue(err == nil && id.String() == "mine", "insert replaced the _id", t)
+
+	coll.Drop()
+}
+
+func TestProjection(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("projection")
+	coll.Drop()
+
+	doc, _ := Marshal(Doc{
+		{"_id", 1},
+		{"title", "post"},
+		{"body", "a long text"},
+		{"comments", []Doc{{{"by", "a"}}, {{"by", "b"}}, {{"by", "c"}}}},
+	})
+	coll.Insert(doc)
+
+	q, _ := Marshal(Doc{{"_id", 1}})
+	fields, _ := Marshal(Doc{{"title", 1}})
+	got, err := coll.FindOneFields(q, fields)
+	assertTrue(err == nil && got.Get("title").String() == "post", fmt.Sprintf("projection: %v", err), t)
+	assertTrue(got.Get("body").Kind() == NullKind && got.Get("comments").Kind() == NullKind, "projection returned other fields", t)
+
+	fields, _ = Marshal(Doc{{"comments", Slice(-2)}})
+	got, _ = coll.FindOneFields(q, fields)
+	comments := got.Get("comments")
+	assertTrue(comments.Len() == 2 && comments.Elem(0).Get("by").String() == "b", "$slice", t)
+
+	fields, _ = Marshal(Doc{{"comments", SliceRange(1, 1)}})
+	got, _ = coll.FindOneFields(q, fields)
+	assertTrue(got.Get("comments").Len() == 1 && got.Get("comments").Elem(0).Get("by").String() == "b", "$slice range", t)
+
+	fields, _ = Marshal(Doc{{"comments", ElemMatch(Doc{{"by", "c"}})}})
+	cursor, _ := coll.FindAllFields(q, fields)
+	got, _ = cursor.GetNext()
+	assertTrue(got.Get("comments").Len() == 1 && got.Get("comments").Elem(0).Get("by").String() == "c", "$elemMatch", t)
+
+	coll.Drop()
+}
+
+type Person struct {
+	Name string
+	Age  int32
+}
+
+func TestFind(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("people")
+	coll.Drop()
+	for i, name := range []string{"ann", "bob", "cid", "dan", "eve"} {
+		doc, _ := Marshal(&Person{name, int32(20 + i%3)})
+		coll.Insert(doc)
+	}
+
+	var people []Person
+	err = coll.Find(nil).Sort("-age", "name").Skip(1).Limit(3).All(&people)
+	assertTrue(err == nil && len(people) == 3, fmt.Sprintf("All: %v, %v", people, err), t)
+	if len(people) == 3 {
+		assertTrue(people[0].Name == "bob" && people[1].Name == "eve" && people[2].Name == "ann", fmt.Sprintf("sort: %v", people), t)
+	}
+
+	var p Person
+	err = coll.Find(Doc{{"age", 21}}).Sort("name").Comment("test").One(&p)
+	assertTrue(err == nil && p.Name == "bob", fmt.Sprintf("One: %v, %v", p, err), t)
+	err = coll.Find(Doc{{"age", 99}}).One(&p)
+	assertTrue(err == ErrNotFound, fmt.Sprintf("One of nothing: %v", err), t)
+
+	var docs []BSON
+	err = coll.Find(nil).Select(Doc{{"name", 1}, {"_id", 0}}).Batch(2).All(&docs)
+	assertTrue(err == nil && len(docs) == 5, fmt.Sprintf("All BSON in batches: %v", err), t)
+	assertTrue(docs[0].Get("age").Kind() == NullKind, "Select", t)
+
+	n, err := coll.Find(Doc{{"age", Doc{{"$gte", 21}}}}).Count()
+	assertTrue(err == nil && n == 3, fmt.Sprintf("Count: %d, %v", n, err), t)
+	n, _ = coll.Find(nil).Skip(1).Limit(2).Count()
+	assertTrue(n == 2, "Count with skip and limit", t)
+
+	var plan BSON
+	err = coll.Find(nil).Hint(Doc{{"_id", 1}}).Explain(&plan)
+	assertTrue(err == nil && plan.Kind() == ObjectKind, fmt.Sprintf("Explain: %v", err), t)
+
+	cursor := coll.Find(Doc{{"$bad", 1}}).Iter()
+	_, err = cursor.GetNext()
+	_, isQueryError := err.(*QueryError)
+	assertTrue(isQueryError, fmt.Sprintf("Iter of a bad query gave %v", err), t)
+
+	coll.Drop()
+}
+
+func TestBatchSize(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("batches")
+	coll.Drop()
+	for i := 0; i < 10; i++ {
+		doc, _ := Marshal(Doc{{"i", i}})
+		coll.Insert(doc)
+	}
+
+	cursor := coll.Find(nil).Batch(3).Limit(7).Iter()
+	assertTrue(cursor.docs.Len() == 3, fmt.Sprintf("first batch of %d", cursor.docs.Len()), t)
+	var docs []BSON
+	err = cursor.All(&docs)
+	assertTrue(err == nil && len(docs) == 7, fmt.Sprintf("Batch(3).Limit(7) gave %d documents: %v", len(docs), err), t)
+
+	cursor = coll.Find(nil).Limit(-4).Iter()
+	assertTrue(!cursor.Alive(), "negative limit left the cursor open", t)
+	cursor.All(&docs)
+	assertTrue(len(docs) == 4, fmt.Sprintf("Limit(-4) gave %d documents", len(docs)), t)
+
+	cursor = coll.Find(nil).Batch(2).Iter()
+	cursor.SetBatchSize(5)
+	n := 0
+	var doc BSON
+	for cursor.Next(&doc) {
+		n++
+		if n == 2 {
+			assertTrue(cursor.docs.Len() == 2, "first batch", t)
+		}
+		if n == 3 {
+			assertTrue(cursor.docs.Len() == 5, fmt.Sprintf("getMore batch of %d", cursor.docs.Len()), t)
+		}
+	}
+	assertTrue(n == 10, fmt.Sprintf("%d documents in batches", n), t)
+
+	coll.Drop()
+}
+
+func TestCursorCleanup(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("cleanup")
+	coll.Drop()
+	for i := 0; i < 10; i++ {
+		doc, _ := Marshal(Doc{{"i", i}})
+		coll.Insert(doc)
+	}
+
+	closed := coll.Find(nil).Batch(2).Iter()
+	closed.Close()
+	drained := coll.Find(nil).Batch(2).Iter()
+	drained.All(new([]BSON))
+	leaked := coll.Find(nil).Batch(2).Iter()
+	id := leaked.id
+
+	open := conn.OpenCursors()
+	assertTrue(len(open) == 1 && open[0].Id == id, fmt.Sprintf("open cursors: %v", open), t)
+	if len(open) == 1 {
+		assertTrue(open[0].Collection == "go_driver_tests.cleanup", "collection of open cursor", t)
+		assertTrue(strings.Contains(open[0].Stack, "TestCursorCleanup"), "stack of open cursor:\n"+open[0].Stack, t)
+	}
+
+	conn.Disconnect()
+	assertTrue(len(conn.OpenCursors()) == 0, "cursors left after Disconnect", t)
+	assertTrue(leaked.Close() == nil, "closing a cursor after Disconnect", t)
+
+	// Disconnect killed the cursor on the server.
+	conn2, _ := Connect("127.0.0.1")
+	defer conn2.Disconnect()
+	coll2 := conn2.GetDB("go_driver_tests").GetCollection("cleanup")
+	stale := &Cursor{collection: coll2, id: id, docs: new(vector.Vector)}
+	err = stale.GetMore()
+	assertTrue(err == ErrCursorNotFound, fmt.Sprintf("getMore on a killed cursor gave %v", err), t)
+
+	coll2.Drop()
+}
+
+func TestTailIterator(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	db := conn.GetDB("go_driver_tests")
+	coll := db.GetCollection("capped")
+	coll.Drop()
+	cmd, _ := Marshal(Doc{{"create", "capped"}, {"capped", true}, {"size", 4096}})
+	_, err = db.Command(cmd)
+	assertTrue(err == nil, fmt.Sprintf("create capped collection: %v", err), t)
+
+	tail := coll.Find(nil).Tail(5e8)
+	defer tail.Close()
+	var p Person
+	err = tail.Next(&p)
+	assertTrue(err == ErrCursorDead, fmt.Sprintf("tailing an empty collection gave %v", err), t)
+
+	insert := func(name string) {
+		doc, _ := Marshal(&Person{name, 1})
+		coll.Insert(doc)
+	}
+	insert("a")
+	insert("b")
+	err = tail.Next(&p)
+	assertTrue(err == nil && p.Name == "a", fmt.Sprintf("first: %v, %v", p, err), t)
+	err = tail.Next(&p)
+	assertTrue(err == nil && p.Name == "b", fmt.Sprintf("second: %v, %v", p, err), t)
+
+	err = tail.Next(&p)
+	assertTrue(err == ErrTimeout, fmt.Sprintf("no new document gave %v", err), t)
+
+	go func() {
+		time.Sleep(2e8)
+		insert("c")
+	}()
+	err = tail.Next(&p)
+	assertTrue(err == nil && p.Name == "c", fmt.Sprintf("waiting: %v, %v", p, err), t)
+
+	// A new cursor resumes after the last document seen.
+	tail.Close()
+	insert("d")
+	err = tail.Next(&p)
+	assertTrue(err == nil && p.Name == "d", fmt.Sprintf("resumed: %v, %v", p, err), t)
+
+	coll.Drop()
+}
+
+func TestInsertMany(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("127.0.0.1:27017")
+	// Small messages, to split the inserts in many batches.
+	conn, err := ConnectByAddrPool(addr, PoolOptions{MaxSockets: 1, MaxMessageSize: 1024})
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("many")
+	coll.Drop()
+
+	docs := make([]interface{}, 100)
+	for i := range docs {
+		docs[i] = Doc{{"i", i}, {"text", "some text to make the documents bigger"}}
+	}
+	ids, err := coll.InsertMany(docs...)
+	assertTrue(err == nil && len(ids) == 100, fmt.Sprintf("InsertMany: %v", err), t)
+	n, _ := coll.Find(nil).Count()
+	assertTrue(n == 100, fmt.Sprintf("%d documents inserted", n), t)
+	assertTrue(ids[0].Kind() == OIDKind, "no _id assigned", t)
+
+	coll.Drop()
+	dups := []interface{}{Doc{{"_id", 1}}, Doc{{"_id", 1}}, Doc{{"_id", 2}}}
+	_, err = coll.InsertMany(dups...)
+	ierr, ok := err.(*InsertManyError)
+	assertTrue(ok && len(ierr.Batches) == 1, fmt.Sprintf("duplicate _id gave %v", err), t)
+	if ok && len(ierr.Batches) == 1 {
+		werr, _ := ierr.Batches[0].Err.(*WriteError)
+		assertTrue(werr != nil && werr.Code == 11000, fmt.Sprintf("batch error: %v", ierr.Batches[0].Err), t)
+	}
+	n, _ = coll.Find(nil).Count()
+	assertTrue(n == 1, fmt.Sprintf("ordered insert went on after the error: %d documents", n), t)
+
+	coll.Drop()
+	_, err = coll.InsertManyContinueOnError(dups...)
+	assertTrue(err != nil, "no error for duplicate _id", t)
+	n, _ = coll.Find(nil).Count()
+	assertTrue(n == 2, fmt.Sprintf("ContinueOnError stopped at the error: %d documents", n), t)
+
+	coll.Drop()
+}
+
+func TestBulk(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("bulk")
+	coll.Drop()
+
+	bulk := coll.Bulk()
+	bulk.Insert(Doc{{"_id", 1}, {"n", 1}}, Doc{{"_id", 2}, {"n", 1}}, Doc{{"_id", 3}, {"n", 1}})
+	bulk.UpdateAll(Doc{{"n", 1}}, Doc{{"$set", Doc{{"n", 2}}}})
+	bulk.Update(Doc{{"_id", 1}}, Doc{{"$set", Doc{{"n", 2}}}})
+	bulk.Upsert(Doc{{"_id", 4}}, Doc{{"$set", Doc{{"n", 4}}}})
+	bulk.RemoveOne(Doc{{"n", 2}})
+	bulk.Remove(Doc{{"n", 2}})
+	result, err := bulk.Run()
+	assertTrue(err == nil, fmt.Sprintf("ordered bulk: %v", err), t)
+	assertTrue(result.Inserted == 3 && result.Matched == 4 && result.Upserted == 1 && result.Removed == 3,
+		fmt.Sprintf("ordered bulk result: %+v", result), t)
+	assertTrue(len(result.Upserts) == 1 && result.Upserts[0].Index == 5, fmt.Sprintf("upserts: %v", result.Upserts), t)
+
+	// An ordered bulk stops at the first failure.
+	coll.Drop()
+	bulk = coll.Bulk()
+	bulk.Insert(Doc{{"_id", 1}}, Doc{{"_id", 1}}, Doc{{"_id", 2}})
+	result, err = bulk.Run()
+	_, ok := err.(BulkErrors)
+	assertTrue(ok && len(result.Errors) == 1 && result.Errors[0].Index == 1, fmt.Sprintf("ordered failure: %v", err), t)
+	assertTrue(result.Inserted == 1, fmt.Sprintf("ordered bulk went on after failure: %+v", result), t)
+
+	// An unordered one goes on.
+	coll.Drop()
+	bulk = coll.Bulk()
+	bulk.Unordered()
+	for i := 0; i < 1000; i++ {
+		bulk.Insert(Doc{{"_id", i % 900}})
+	}
+	result, err = bulk.Run()
+	assertTrue(err != nil && len(result.Errors) == 100, fmt.Sprintf("unordered failures: %d", len(result.Errors)), t)
+	if len(result.Errors) > 0 {
+		assertTrue(result.Errors[0].Index == 900, fmt.Sprintf("first failure at %d", result.Errors[0].Index), t)
+	}
+	assertTrue(result.Inserted == 900, fmt.Sprintf("unordered bulk inserted %d", result.Inserted), t)
+
+	bulk = coll.Bulk()
+	bulk.Insert("not a document")
+	_, err = bulk.Run()
+	assertTrue(err != nil, "queued a string as a document", t)
+
+	coll.Drop()
+}
+
+func TestConcurrentUse(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("127.0.0.1:27017")
+	conn, err := ConnectByAddrPool(addr, PoolOptions{MinSockets: 2, MaxSockets: 4})
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("concurrent")
+	coll.Drop()
+
+	const workers = 16
+	done := make(chan os.Error, workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			doc, _ := Marshal(map[string]int{"worker": i})
+			if _, err := coll.Insert(doc); err != nil {
+				done <- err
+				return
+			}
+			got, err := coll.FindOne(doc)
+			if err == nil && got.Get("worker").Long() != int64(i) {
+				err = os.NewError(fmt.Sprintf("worker %d got %v", i, got.Get("worker").Long()))
+			}
+			done <- err
+		}(i)
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+
+	stats := conn.Pool().Stats()
+	assertTrue(stats.Open <= 4, fmt.Sprintf("pool opened %d sockets", stats.Open), t)
+	assertTrue(stats.Idle == stats.Open, "sockets not checked in", t)
+
+	coll.Drop()
+}
+
+func TestIdleEviction(t *testing.T) {
+	l := stallingServer(t)
+	defer l.Close()
+
+	pool, err := NewPool(l.Addr().(*net.TCPAddr), PoolOptions{MinSockets: 2, MaxIdleTime: 3600e9})
+	if err != nil {
+		t.Fatalf("pool: %v", err)
+	}
+	defer pool.Close()
+
+	var socks []*socket
+	for i := 0; i < 5; i++ {
+		sock, err := pool.checkout(nil)
+		if err != nil {
+			t.Fatalf("checkout: %v", err)
+		}
+		socks = append(socks, sock)
+	}
+	for _, sock := range socks {
+		pool.checkin(sock)
+	}
+
+	// Every socket has been idle too long; only those above MinSockets go.
+	now := time.Nanoseconds() + 2*pool.options.MaxIdleTime
+	pool.mutex.Lock()
+	pool.evictIdle(now)
+	pool.mutex.Unlock()
+
+	stats := pool.Stats()
+	assertTrue(stats.Open == 2 && stats.Idle == 2, fmt.Sprintf("%d open, %d idle after eviction", stats.Open, stats.Idle), t)
+}
+
+func TestWriteConcern(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	coll := conn.GetDB("go_driver_tests").GetCollection("concern")
+	coll.Drop()
+
+	doc, _ := Marshal(map[string]string{"_id": "dup"})
+	_, err = coll.Insert(doc)
+	assertTrue(err == nil, fmt.Sprintf("first insert: %v", err), t)
+
+	_, err = coll.Insert(doc)
+	werr, ok := err.(*WriteError)
+	assertTrue(ok, fmt.Sprintf("duplicate insert returned %v", err), t)
+	if ok {
+		assertTrue(werr.Code == 11000, fmt.Sprintf("duplicate key code %d", werr.Code), t)
+	}
+
+	coll.SetWriteConcern(Unacknowledged)
+	_, err = coll.Insert(doc)
+	assertTrue(err == nil, "unacknowledged insert reported an error", t)
+
+	coll.SetWriteConcern(nil)
+	assertTrue(coll.WriteConcern() == Acknowledged, "default write concern", t)
+
+	coll.Drop()
+}
+
+func TestServerErrors(t *testing.T) {
+	conn, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed connecting to mongo: %v", err)
+	}
+	defer conn.Disconnect()
+
+	db := conn.GetDB("go_driver_tests")
+	cmd, _ := Marshal(Doc{{"noSuchCommand", 1}})
+	_, err = db.Command(cmd)
+	cerr, ok := err.(*CommandError)
+	assertTrue(ok, fmt.Sprintf("failed command returned %v", err), t)
+	if ok {
+		assertTrue(cerr.Name == "noSuchCommand" && cerr.Message != "", "CommandError fields", t)
+	}
+
+	// $where is only evaluated when there is a document to match.
+	coll := db.GetCollection("errors")
+	coll.Insert(EmptyObject)
+	q, _ := Marshal(Doc{{"$where", "this is not javascript("}})
+	_, err = coll.FindOne(q)
+	_, ok = err.(*QueryError)
+	assertTrue(ok, fmt.Sprintf("failed query returned %v", err), t)
+	coll.Drop()
+}
+
 const (
 	PER_TRIAL  = 1000
 	BATCH_SIZE = 100
@@ -139,7 +625,7 @@ func singleInsertSmall(coll *Collection, t *testing.T) {
 			t.Errorf("singleInsertSmall Marshal: %v\n", err)
 		}
 
-		err = coll.Insert(obj)
+		_, err = coll.Insert(obj)
 		if err != nil {
 			t.Errorf("singleInsertSmall Insert: %v\n", err)
 		}
@@ -178,7 +664,7 @@ func singleInsertMedium(coll *Collection, t *testing.T) {
 			t.Errorf("singleInsertMedium Marshal: %v\n", err)
 		}
 
-		err = coll.Insert(obj)
+		_, err = coll.Insert(obj)
 		if err != nil {
 			t.Errorf("singleInsertMedium Insert: %v\n", err)
 		}
@@ -258,7 +744,7 @@ func singleInsertLarge(coll *Collection, t *testing.T) {
 			t.Errorf("singleInsertLarge Marshal: %v", err)
 		}
 
-		err = coll.Insert(obj)
+		_, err = coll.Insert(obj)
 		if err != nil {
 			t.Errorf("singleInsertLarge Insert: %v", err)
 		}
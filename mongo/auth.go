@@ -0,0 +1,447 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* Authentication
+
+https://github.com/mongodb/specifications/blob/master/source/auth/auth.rst
+
+SCRAM-SHA-1 and SCRAM-SHA-256 run as a SASL conversation of saslStart and
+saslContinue commands; servers older than 3.0 get MONGODB-CR instead.
+MONGODB-X509 logs in with the client certificate of TLS sockets.
+*/
+
+package mongo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	crand "github.com/kless/freecrypto/rand"
+)
+
+
+// Authentication mechanisms.
+const (
+	AuthScramSHA1   = "SCRAM-SHA-1"
+	AuthScramSHA256 = "SCRAM-SHA-256"
+	AuthMongoCR     = "MONGODB-CR"
+	AuthMongoX509   = "MONGODB-X509"
+)
+
+/* A user to log in as. The keys derived from the password by SCRAM are
+cached, so that logging in every new socket is cheap. */
+type credential struct {
+	username  string
+	password  string
+	source    string // database holding the user
+	mechanism string // negotiated with the server if empty
+
+	mutex sync.Mutex
+	keys  map[string]*scramKeys // by mechanism, salt and iteration count
+}
+
+/* Logs in as user on every socket of the connection, present and future.
+The credentials are kept, so that new sockets, and the connection got from
+Reconnect, log in too. Logging in to a database again replaces the user
+logged in before. */
+func (self *Database) Login(user, pass string) os.Error {
+	return self.Conn.login(&credential{username: user, password: pass, source: self.name})
+}
+
+/* Logs in as user with the client certificate, on every socket of the
+connection, present and future. If user is empty, it is the subject of the
+certificate. */
+func (self *Connection) LoginX509(user string) os.Error {
+	return self.login(&credential{username: user, source: "$external", mechanism: AuthMongoX509})
+}
+
+/* Checks cred on a socket and, if it is good, has every socket log in with
+it. */
+func (self *Connection) login(cred *credential) os.Error {
+	pool, err := self.primary()
+	if err != nil {
+		return err
+	}
+	sock, err := pool.checkout(nil)
+	if err != nil {
+		return err
+	}
+	defer pool.checkin(sock)
+
+	if err = sock.login(cred); err != nil {
+		return err
+	}
+	self.addCredential(cred)
+	return nil
+}
+
+/* Keeps cred, replacing any credential for the same database. */
+func (self *Pool) addCredential(cred *credential) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i, c := range self.credentials {
+		if c.source == cred.source {
+			self.credentials[i] = cred
+			return
+		}
+	}
+	self.credentials = append(self.credentials, cred)
+}
+
+/* Logs sock in with the credentials it is missing. */
+func (self *Pool) authenticate(sock *socket) os.Error {
+	self.mutex.Lock()
+	credentials := self.credentials
+	self.mutex.Unlock()
+
+	for _, cred := range credentials {
+		if sock.logins[cred.source] == cred {
+			continue
+		}
+		if err := sock.login(cred); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Logs the socket in, and records it. */
+func (self *socket) login(cred *credential) os.Error {
+	mechanism := cred.mechanism
+	if mechanism == "" {
+		var err os.Error
+		if mechanism, err = self.negotiateMechanism(cred); err != nil {
+			return err
+		}
+	}
+
+	var err os.Error
+	switch mechanism {
+	case AuthScramSHA1:
+		err = self.scram(cred, scramSHA1)
+	case AuthScramSHA256:
+		err = self.scram(cred, scramSHA256)
+	case AuthMongoCR:
+		err = self.mongoCR(cred)
+	case AuthMongoX509:
+		err = self.x509(cred)
+	default:
+		err = os.NewError("unsupported authentication mechanism " + mechanism)
+	}
+	if err != nil {
+		return &AuthError{cred.username, cred.source, mechanism, err}
+	}
+
+	if self.logins == nil {
+		self.logins = make(map[string]*credential)
+	}
+	self.logins[cred.source] = cred
+	return nil
+}
+
+/* Picks the best mechanism that the server supports for the user:
+SCRAM-SHA-256 if listed for the user, SCRAM-SHA-1 from 3.0 on, MONGODB-CR
+before. */
+func (self *socket) negotiateMechanism(cred *credential) (string, os.Error) {
+	reply, err := self.command("admin", Doc{
+		{"isMaster", 1},
+		{"saslSupportedMechs", cred.source + "." + cred.username},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if mechs := reply.Get("saslSupportedMechs"); mechs.Kind() == ArrayKind {
+		for i := 0; i < mechs.Len(); i++ {
+			if mechs.Elem(i).String() == AuthScramSHA256 {
+				return AuthScramSHA256, nil
+			}
+		}
+	}
+	if toInt(reply.Get("maxWireVersion")) >= 3 {
+		return AuthScramSHA1, nil
+	}
+	return AuthMongoCR, nil
+}
+
+/* Runs a command on the socket, returning a *CommandError if the server
+replies with {ok: 0}. */
+func (self *socket) command(db string, cmd interface{}) (BSON, os.Error) {
+	b, err := Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := self.roundTrip(&opQuery{o_NONE, db + ".$cmd", 0, -1, b, nil})
+	if err != nil {
+		return nil, err
+	}
+	if reply.documents.Len() == 0 {
+		return nil, os.NewError("no reply to command")
+	}
+
+	doc := reply.documents.At(0).(BSON)
+	return doc, commandError(b, doc)
+}
+
+/* A failure to log in. */
+type AuthError struct {
+	Username  string
+	Source    string
+	Mechanism string
+	Err       os.Error
+}
+
+func (self *AuthError) String() string {
+	return fmt.Sprintf("authentication of %s on %s with %s failed: %s",
+		self.Username, self.Source, self.Mechanism, self.Err)
+}
+
+
+// === SCRAM
+// ===
+
+type scramMechanism struct {
+	name string
+	hash func() hash.Hash
+}
+
+var (
+	scramSHA1   = &scramMechanism{AuthScramSHA1, sha1.New}
+	scramSHA256 = &scramMechanism{AuthScramSHA256, sha256.New}
+)
+
+// Empty saslContinue rounds done after the server's final message before
+// giving up on the conversation.
+const maxEmptySaslRounds = 2
+
+/* Keys derived from the salted password. */
+type scramKeys struct {
+	client, server []byte
+}
+
+/* Runs the SCRAM conversation of RFC 5802. */
+func (self *socket) scram(cred *credential, mech *scramMechanism) os.Error {
+	nonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+
+	clientFirst := "n=" + saslName(cred.username) + ",r=" + nonce
+	reply, err := self.command(cred.source, Doc{
+		{"saslStart", 1},
+		{"mechanism", mech.name},
+		{"payload", []byte("n,," + clientFirst)},
+		{"autoAuthorize", 1},
+	})
+	if err != nil {
+		return err
+	}
+	conversationId := reply.Get("conversationId")
+
+	_, serverFirst := reply.Get("payload").Binary()
+	fields := scramFields(string(serverFirst))
+	salt, err := base64.StdEncoding.DecodeString(fields["s"])
+	if err != nil {
+		return os.NewError("bad salt from the server")
+	}
+	iterations, err := strconv.Atoi(fields["i"])
+	if err != nil || iterations < 4096 {
+		return os.NewError("bad iteration count from the server")
+	}
+	if !strings.HasPrefix(fields["r"], nonce) || len(fields["r"]) == len(nonce) {
+		return os.NewError("bad nonce from the server")
+	}
+
+	keys := cred.scramKeys(mech, salt, iterations)
+	withoutProof := "c=biws,r=" + fields["r"]
+	authMessage := clientFirst + "," + string(serverFirst) + "," + withoutProof
+
+	proof := mech.proof(keys, authMessage)
+	clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	reply, err = self.command(cred.source, Doc{
+		{"saslContinue", 1},
+		{"conversationId", conversationId},
+		{"payload", []byte(clientFinal)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, serverFinal := reply.Get("payload").Binary()
+	fields = scramFields(string(serverFinal))
+	if e, ok := fields["e"]; ok {
+		return os.NewError(e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(fields["v"])
+	if err != nil || !bytes.Equal(signature, mech.hmac(keys.server, authMessage)) {
+		return os.NewError("bad server signature")
+	}
+
+	// Some servers want one more, empty, round to be done.
+	for rounds := 0; !reply.Get("done").Bool(); rounds++ {
+		if rounds == maxEmptySaslRounds {
+			return os.NewError("server didn't end the SASL conversation")
+		}
+		reply, err = self.command(cred.source, Doc{
+			{"saslContinue", 1},
+			{"conversationId", conversationId},
+			{"payload", []byte{}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Gets the client and server keys, deriving them only once for a given
+salt and iteration count. */
+func (self *credential) scramKeys(mech *scramMechanism, salt []byte, iterations int) *scramKeys {
+	id := fmt.Sprintf("%s:%x:%d", mech.name, salt, iterations)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if keys, ok := self.keys[id]; ok {
+		return keys
+	}
+
+	password := self.password
+	if mech == scramSHA1 {
+		// SCRAM-SHA-1 salts the MONGODB-CR digest rather than the password.
+		password = passwordDigest(self.username, self.password)
+	}
+	salted := mech.hi([]byte(password), salt, iterations)
+	keys := &scramKeys{mech.hmac(salted, "Client Key"), mech.hmac(salted, "Server Key")}
+
+	if self.keys == nil {
+		self.keys = make(map[string]*scramKeys)
+	}
+	self.keys[id] = keys
+	return keys
+}
+
+/* Gets the client proof: the client key XOR the client signature. */
+func (self *scramMechanism) proof(keys *scramKeys, authMessage string) []byte {
+	storedKey := self.hash()
+	storedKey.Write(keys.client)
+	proof := self.hmac(storedKey.Sum(), authMessage)
+	for i := range proof {
+		proof[i] ^= keys.client[i]
+	}
+	return proof
+}
+
+func (self *scramMechanism) hmac(key []byte, s string) []byte {
+	h := hmac.New(self.hash, key)
+	h.Write([]byte(s))
+	return h.Sum()
+}
+
+/* PBKDF2 with HMAC as pseudorandom function, for a single block. */
+func (self *scramMechanism) hi(password, salt []byte, iterations int) []byte {
+	h := hmac.New(self.hash, password)
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum()
+
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum()
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scramNonce() (string, os.Error) {
+	b := make([]byte, 24)
+	if err := crand.ReadUrandom(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+/* Escapes a user name for SASL. */
+func saslName(name string) string {
+	name = strings.Replace(name, "=", "=3D", -1)
+	return strings.Replace(name, ",", "=2C", -1)
+}
+
+/* Splits a SCRAM message such as "r=...,s=...,i=4096" into its fields. */
+func scramFields(msg string) map[string]string {
+	fields := make(map[string]string)
+	for _, f := range strings.Split(msg, ",", -1) {
+		if len(f) >= 2 && f[1] == '=' {
+			fields[f[0:1]] = f[2:]
+		}
+	}
+	return fields
+}
+
+
+// === MONGODB-CR
+// ===
+
+func (self *socket) mongoCR(cred *credential) os.Error {
+	reply, err := self.command(cred.source, Doc{{"getnonce", 1}})
+	if err != nil {
+		return err
+	}
+	nonce := reply.Get("nonce").String()
+
+	h := md5.New()
+	h.Write([]byte(nonce + cred.username + passwordDigest(cred.username, cred.password)))
+	_, err = self.command(cred.source, Doc{
+		{"authenticate", 1},
+		{"user", cred.username},
+		{"nonce", nonce},
+		{"key", hex.EncodeToString(h.Sum())},
+	})
+	return err
+}
+
+/* The digest of the password kept by the server for MONGODB-CR. */
+func passwordDigest(user, pass string) string {
+	h := md5.New()
+	h.Write([]byte(user + ":mongo:" + pass))
+	return hex.EncodeToString(h.Sum())
+}
+
+
+// === MONGODB-X509
+// ===
+
+func (self *socket) x509(cred *credential) os.Error {
+	user := cred.username
+	if user == "" {
+		var err os.Error
+		if user, err = self.pool.dialer.clientSubject(); err != nil {
+			return err
+		}
+	}
+
+	_, err := self.command("$external", Doc{
+		{"authenticate", 1},
+		{"mechanism", AuthMongoX509},
+		{"user", user},
+	})
+	return err
+}
@@ -0,0 +1,308 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* A server that knows a single user and answers the authentication
+commands, recording the name of every command it gets. */
+type fakeAuthServer struct {
+	user, pass  string
+	mechs       []string // saslSupportedMechs of the user
+	wireVersion int
+	badSig      bool // sends a wrong server signature
+	neverDone   bool // never ends the SASL conversation
+
+	commands  []string
+	mechanism string // of the last saslStart
+}
+
+var fakeSalt = []byte("pepper-and-salt")
+
+/* Answers the commands of a client until it hangs up. */
+func (self *fakeAuthServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var mech *scramMechanism
+	var authMessage string
+	authenticated := false
+	nonce := ""
+
+	for {
+		reqID, cmd, err := readCommand(conn)
+		if err != nil {
+			return
+		}
+		name := cmd.(*_Object).keys[0]
+		self.commands = append(self.commands, name)
+
+		reply := Doc{{"ok", 1}}
+		switch name {
+		case "isMaster":
+			reply = append(reply, DocElem{"maxWireVersion", self.wireVersion})
+			if self.mechs != nil {
+				reply = append(reply, DocElem{"saslSupportedMechs", self.mechs})
+			}
+
+		case "saslStart":
+			mech = scramSHA1
+			self.mechanism = cmd.Get("mechanism").String()
+			if self.mechanism == AuthScramSHA256 {
+				mech = scramSHA256
+			}
+			_, payload := cmd.Get("payload").Binary()
+			clientFirst := string(payload[3:]) // after "n,,"
+			fields := scramFields(clientFirst)
+			if fields["n"] != self.user {
+				reply = Doc{{"ok", 0}, {"code", 18}, {"errmsg", "Authentication failed."}}
+				break
+			}
+			serverFirst := fmt.Sprintf("r=%sserver,s=%s,i=4096", fields["r"], base64.StdEncoding.EncodeToString(fakeSalt))
+			authMessage = clientFirst + "," + serverFirst
+			reply = Doc{{"conversationId", 1}, {"done", false}, {"payload", []byte(serverFirst)}, {"ok", 1}}
+
+		case "saslContinue":
+			_, payload := cmd.Get("payload").Binary()
+			if len(payload) == 0 {
+				reply = Doc{{"conversationId", 1}, {"done", !self.neverDone}, {"payload", []byte{}}, {"ok", 1}}
+				break
+			}
+			clientFinal := string(payload)
+			i := strings.Index(clientFinal, ",p=")
+			authMessage += "," + clientFinal[:i]
+
+			cred := &credential{username: self.user, password: self.pass}
+			keys := cred.scramKeys(mech, fakeSalt, 4096)
+			proof, _ := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+			if !bytes.Equal(proof, mech.proof(keys, authMessage)) {
+				reply = Doc{{"ok", 0}, {"code", 18}, {"errmsg", "Authentication failed."}}
+				break
+			}
+			signature := mech.hmac(keys.server, authMessage)
+			if self.badSig {
+				signature[0]++
+			}
+			serverFinal := "v=" + base64.StdEncoding.EncodeToString(signature)
+			reply = Doc{{"conversationId", 1}, {"done", false}, {"payload", []byte(serverFinal)}, {"ok", 1}}
+			authenticated = true
+
+		case "getnonce":
+			nonce = "2375531c32080ae8"
+			reply = append(reply, DocElem{"nonce", nonce})
+
+		case "authenticate":
+			if cmd.Get("mechanism").String() == AuthMongoX509 {
+				if !self.x509Login(conn, cmd.Get("user").String()) {
+					reply = Doc{{"ok", 0}, {"code", 18}, {"errmsg", "auth failed"}}
+					break
+				}
+				authenticated = true
+				break
+			}
+
+			h := md5.New()
+			h.Write([]byte(nonce + self.user + passwordDigest(self.user, self.pass)))
+			if cmd.Get("key").String() != hex.EncodeToString(h.Sum()) {
+				reply = Doc{{"ok", 0}, {"code", 18}, {"errmsg", "auth failed"}}
+				break
+			}
+			authenticated = true
+
+		default:
+			if !authenticated {
+				reply = Doc{{"ok", 0}, {"code", 13}, {"errmsg", "unauthorized"}}
+			}
+		}
+
+		doc, _ := Marshal(reply)
+		conn.Write(framed(replyBytes(reqID, 0, 0, doc)))
+	}
+}
+
+/* Checks that user is the subject of the client certificate. */
+func (self *fakeAuthServer) x509Login(conn net.Conn, user string) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || user != self.user {
+		return false
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return false
+	}
+	subject, err := x509Subject(certs[0])
+	return err == nil && subject == user
+}
+
+/* Reads a message, returning its requestID, its opCode and its body. */
+func readMessage(r io.Reader) (int32, int32, []byte, os.Error) {
+	head := make([]byte, _HEADER_SIZE)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, 0, nil, err
+	}
+	body := make([]byte, pack.Uint32(head[0:4])-_HEADER_SIZE)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return int32(pack.Uint32(head[4:8])), int32(pack.Uint32(head[12:16])), body, nil
+}
+
+/* Reads an OP_QUERY, returning its requestID and its query document. */
+func readCommand(r io.Reader) (int32, BSON, os.Error) {
+	reqID, opCode, body, err := readMessage(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if opCode != _OP_QUERY {
+		return 0, nil, os.NewError(fmt.Sprintf("opCode %d is not OP_QUERY", opCode))
+	}
+	doc, err := queryDocument(body)
+	return reqID, doc, err
+}
+
+/* Gets the query document of the body of an OP_QUERY. */
+func queryDocument(body []byte) (BSON, os.Error) {
+	// Skips the flags, the collection name, numberToSkip and numberToReturn.
+	body = body[4:]
+	body = body[bytes.IndexByte(body, 0)+9:]
+	return BytesToBSON(body[0:pack.Uint32(body[0:4])])
+}
+
+/* Logs in a socket served by server. */
+func fakeLogin(server *fakeAuthServer, cred *credential) os.Error {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.serve(conn)
+
+	sock := &socket{pool: &Pool{options: DefaultPoolOptions}, conn: client}
+	return sock.login(cred)
+}
+
+func TestScramVectors(t *testing.T) {
+	// RFC 7677, section 3.
+	clientFirst := "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	withoutProof := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	authMessage := clientFirst + "," + serverFirst + "," + withoutProof
+
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	cred := &credential{username: "user", password: "pencil"}
+	keys := cred.scramKeys(scramSHA256, salt, 4096)
+
+	proof := base64.StdEncoding.EncodeToString(scramSHA256.proof(keys, authMessage))
+	assertTrue(proof == "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", "client proof: "+proof, t)
+	signature := base64.StdEncoding.EncodeToString(scramSHA256.hmac(keys.server, authMessage))
+	assertTrue(signature == "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", "server signature: "+signature, t)
+
+	assertTrue(cred.scramKeys(scramSHA256, salt, 4096) == keys, "keys derived again", t)
+	assertTrue(saslName("a=b,c") == "a=3Db=2Cc", "user name escaping", t)
+}
+
+func TestScramLogin(t *testing.T) {
+	tests := []struct {
+		server fakeAuthServer
+		mech   string
+	}{
+		{fakeAuthServer{user: "bob", pass: "secret", wireVersion: 6, mechs: []string{AuthScramSHA1, AuthScramSHA256}}, AuthScramSHA256},
+		{fakeAuthServer{user: "bob", pass: "secret", wireVersion: 6, mechs: []string{AuthScramSHA1}}, AuthScramSHA1},
+		{fakeAuthServer{user: "bob", pass: "secret", wireVersion: 3}, AuthScramSHA1},
+	}
+
+	for _, test := range tests {
+		server := test.server
+		err := fakeLogin(&server, &credential{username: "bob", password: "secret", source: "db"})
+		assertTrue(err == nil, fmt.Sprintf("%s login failed: %v", test.mech, err), t)
+
+		expected := "isMaster saslStart saslContinue saslContinue"
+		got := strings.Join(server.commands, " ")
+		assertTrue(got == expected, fmt.Sprintf("%s login sent %s", test.mech, got), t)
+		assertTrue(server.mechanism == test.mech, fmt.Sprintf("%s login used %s", test.mech, server.mechanism), t)
+	}
+
+	server := fakeAuthServer{user: "bob", pass: "secret", wireVersion: 6}
+	err := fakeLogin(&server, &credential{username: "bob", password: "wrong", source: "db", mechanism: AuthScramSHA1})
+	_, ok := err.(*AuthError)
+	assertTrue(ok, fmt.Sprintf("wrong password gave %v", err), t)
+
+	server = fakeAuthServer{user: "bob", pass: "secret", wireVersion: 6, badSig: true}
+	err = fakeLogin(&server, &credential{username: "bob", password: "secret", source: "db", mechanism: AuthScramSHA1})
+	assertTrue(err != nil && strings.Contains(err.String(), "server signature"), fmt.Sprintf("bad server signature gave %v", err), t)
+
+	server = fakeAuthServer{user: "bob", pass: "secret", wireVersion: 6, neverDone: true}
+	err = fakeLogin(&server, &credential{username: "bob", password: "secret", source: "db", mechanism: AuthScramSHA1})
+	assertTrue(err != nil && strings.Contains(err.String(), "SASL conversation"), fmt.Sprintf("endless conversation gave %v", err), t)
+	got := strings.Join(server.commands, " ")
+	assertTrue(got == "saslStart saslContinue saslContinue saslContinue", "endless conversation sent "+got, t)
+}
+
+func TestMongoCRLogin(t *testing.T) {
+	server := fakeAuthServer{user: "bob", pass: "secret", wireVersion: 2}
+	err := fakeLogin(&server, &credential{username: "bob", password: "secret", source: "db"})
+	assertTrue(err == nil, fmt.Sprintf("MONGODB-CR login failed: %v", err), t)
+	got := strings.Join(server.commands, " ")
+	assertTrue(got == "isMaster getnonce authenticate", "MONGODB-CR login sent "+got, t)
+
+	server = fakeAuthServer{user: "bob", pass: "secret", wireVersion: 2}
+	err = fakeLogin(&server, &credential{username: "bob", password: "wrong", source: "db"})
+	assertTrue(err != nil, "MONGODB-CR login with a wrong password", t)
+}
+
+func TestLoginReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server := &fakeAuthServer{user: "bob", pass: "secret", wireVersion: 6}
+			go server.serve(conn)
+		}
+	}()
+
+	_, err = ConnectURI("mongodb://bob:wrong@" + l.Addr().String() + "/db")
+	assertTrue(err != nil, "connected with a wrong password", t)
+
+	conn, err := ConnectURI("mongodb://bob:secret@" + l.Addr().String() + "/db")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer conn.Disconnect()
+
+	ping, _ := Marshal(Doc{{"ping", 1}})
+	_, err = conn.GetDB("db").Command(ping)
+	assertTrue(err == nil, fmt.Sprintf("command after login: %v", err), t)
+
+	// The new connection's socket logs in before running the command.
+	conn2, err := conn.Reconnect()
+	if err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	defer conn2.Disconnect()
+	_, err = conn2.GetDB("db").Command(ping)
+	assertTrue(err == nil, fmt.Sprintf("command after reconnect: %v", err), t)
+
+	// A wrong login is not kept.
+	err = conn2.GetDB("db").Login("bob", "wrong")
+	assertTrue(err != nil, "login with a wrong password", t)
+	_, err = conn2.GetDB("db").Command(ping)
+	assertTrue(err == nil, fmt.Sprintf("command after a failed login: %v", err), t)
+}
@@ -8,14 +8,16 @@
 package mongo
 
 import (
+	"bytes"
 	"reflect"
 	"strings"
 	"fmt"
 	"os"
-	"bytes"
 	"time"
 	"container/vector"
+	"sort"
 	"strconv"
+	"sync"
 )
 
 type structBuilder struct {
@@ -24,6 +26,9 @@ type structBuilder struct {
 	// if map_ != nil, write val to map_[key] on each change
 	map_ *reflect.MapValue
 	key  reflect.Value
+
+	// first error returned by a BSONUnmarshaler or Setter
+	errp *os.Error
 }
 
 var nobuilder *structBuilder
@@ -43,6 +48,20 @@ func setfloat(v reflect.Value, f float64) {
 	}
 }
 
+/* Sets a slice of bytes, or of any other uint8 type. */
+func setbytes(v *reflect.SliceValue, b []byte) {
+	st := v.Type().(*reflect.SliceType)
+	if _, ok := st.Elem().(*reflect.UintType); !ok || st.Elem().Size() != 1 {
+		return
+	}
+
+	nv := reflect.MakeSlice(st, len(b), len(b))
+	for i, c := range b {
+		nv.Elem(i).(*reflect.UintValue).Set(uint64(c))
+	}
+	v.Set(nv)
+}
+
 func setint(v reflect.Value, i int64) {
 	switch v := v.(type) {
 	case *reflect.IntValue:
@@ -143,7 +162,7 @@ func (self *structBuilder) OID(oid []byte) {
 		return
 	}
 	if v, ok := self.val.(*reflect.SliceValue); ok {
-		if v.Cap() < 12 {
+		if v.Len() != 12 {
 			nv := reflect.MakeSlice(v.Type().(*reflect.SliceType), 12, 12)
 			v.Set(nv)
 		}
@@ -153,6 +172,82 @@ func (self *structBuilder) OID(oid []byte) {
 	}
 }
 
+func (self *structBuilder) Binary(subtype byte, data []byte) {
+	if self == nil {
+		return
+	}
+	switch v := self.val.(type) {
+	case *reflect.SliceValue:
+		setbytes(v, data)
+	case *reflect.StructValue:
+		if v.Type() == binaryType {
+			v.SetValue(reflect.NewValue(Binary{subtype, data}))
+		}
+	}
+}
+
+func (self *structBuilder) Timestamp(ts int64) {
+	if self == nil {
+		return
+	}
+	setint(self.val, ts)
+}
+
+func (self *structBuilder) Code(code string) {
+	self.CodeWithScope(code, nil)
+}
+
+func (self *structBuilder) CodeWithScope(code string, scope BSON) {
+	if self == nil {
+		return
+	}
+	switch v := self.val.(type) {
+	case *reflect.StringValue:
+		v.Set(code)
+	case *reflect.StructValue:
+		if v.Type() == javaScriptType {
+			js := JavaScript{Code: code}
+			if scope != nil {
+				js.Scope = scope
+			}
+			v.SetValue(reflect.NewValue(js))
+		}
+	}
+}
+
+func (self *structBuilder) Symbol(s string) {
+	self.String(s)
+}
+
+func (self *structBuilder) DBPointer(namespace string, oid []byte) {
+	if self == nil {
+		return
+	}
+	if v, ok := self.val.(*reflect.StructValue); ok && v.Type() == dbPointerType {
+		v.SetValue(reflect.NewValue(DBPointer{namespace, oid}))
+	}
+}
+
+/* Sets a Decimal128, or a string with its text form. Other numeric types
+are left alone, as that could lose precision. */
+func (self *structBuilder) Decimal128(d Decimal128) {
+	if self == nil {
+		return
+	}
+	switch v := self.val.(type) {
+	case *reflect.StringValue:
+		v.Set(d.String())
+	case *reflect.StructValue:
+		if v.Type() == decimal128Type {
+			v.SetValue(reflect.NewValue(d))
+		}
+	}
+}
+
+func (self *structBuilder) Undefined() {}
+func (self *structBuilder) MinKey()    {}
+func (self *structBuilder) MaxKey()    {}
+
 func (self *structBuilder) Array() {
 	if self == nil {
 		return
@@ -171,7 +266,7 @@ func (self *structBuilder) Elem(i int) Builder {
 	switch v := self.val.(type) {
 	case *reflect.ArrayValue:
 		if i < v.Len() {
-			return &structBuilder{val: v.Elem(i)}
+			return self.child(v.Elem(i), nil, nil)
 		}
 	case *reflect.SliceValue:
 		if i > v.Cap() {
@@ -190,7 +285,7 @@ func (self *structBuilder) Elem(i int) Builder {
 			v.SetLen(i + 1)
 		}
 		if i < v.Len() {
-			return &structBuilder{val: v.Elem(i)}
+			return self.child(v.Elem(i), nil, nil)
 		}
 	}
 	return nobuilder
@@ -219,37 +314,44 @@ func (self *structBuilder) Key(k string) Builder {
 	}
 	switch v := reflect.Indirect(self.val).(type) {
 	case *reflect.StructValue:
-		t := v.Type().(*reflect.StructType)
-		// Case-insensitive field lookup.
-		k = strings.ToLower(k)
-		for i := 0; i < t.NumField(); i++ {
-			if strings.ToLower(t.Field(i).Name) == k {
-				return &structBuilder{val: v.Field(i)}
+		info, err := getStructInfo(v.Type().(*reflect.StructType))
+		if err != nil {
+			return nobuilder
+		}
+		if f := info.field(k); f != nil {
+			return self.child(fieldByIndex(v, f.index), nil, nil)
+		}
+		if info.inlineMap != nil {
+			m := fieldByIndex(v, info.inlineMap).(*reflect.MapValue)
+			if m.IsNil() {
+				m.Set(reflect.MakeMap(m.Type().(*reflect.MapType)))
 			}
+			return (&structBuilder{val: m, errp: self.errp}).Key(k)
 		}
 	case *reflect.MapValue:
 		t := v.Type().(*reflect.MapType)
 		if t.Key() != reflect.Typeof(k) {
 			break
 		}
+		// Map elements can't be addressed, so the value is decoded into a
+		// copy, which pointer methods can take, and stored on Flush.
 		key := reflect.NewValue(k)
-		elem := v.Elem(key)
-		if elem == nil {
-			v.SetElem(key, reflect.MakeZero(t.Elem()))
-			elem = v.Elem(key)
+		elem := reflect.MakeZero(t.Elem())
+		if old := v.Elem(key); old != nil {
+			elem.SetValue(old)
 		}
-		return &structBuilder{val: elem, map_: v, key: key}
+		return self.child(elem, v, key)
 	case *reflect.SliceValue:
 		index, err := strconv.Atoi(k)
 		if err != nil {
 			return nobuilder
 		}
 		if index < v.Len() {
-			return &structBuilder{val: v.Elem(index)}
+			return self.child(v.Elem(index), nil, nil)
 		}
 		if index < v.Cap() {
 			v.SetLen(index + 1)
-			return &structBuilder{val: v.Elem(index)}
+			return self.child(v.Elem(index), nil, nil)
 		}
 		newCap := v.Cap() * 2
 		if index >= newCap {
@@ -258,23 +360,241 @@ func (self *structBuilder) Key(k string) Builder {
 		temp := reflect.MakeSlice(v.Type().(*reflect.SliceType), index+1, newCap)
 		reflect.Copy(temp, v)
 		v.Set(temp)
-		return &structBuilder{val: v.Elem(index)}
+		return self.child(v.Elem(index), nil, nil)
 	}
 	return nobuilder
 }
 
+/* Gets a builder for val, an element of self. Values whose type has its own
+decoding are handed their whole BSON value at once. */
+func (self *structBuilder) child(val reflect.Value, map_ *reflect.MapValue, key reflect.Value) Builder {
+	sb := &structBuilder{val: val, map_: map_, key: key, errp: self.errp}
+	if target := unmarshalerOf(val); target != nil {
+		b := &setterBuilder{target: target, sb: sb}
+		b.ptr = &b.value
+		return b
+	}
+	return sb
+}
+
+/* Gets the BSONUnmarshaler or Setter of v, if any. An addressable value is
+tried through its address first, to find pointer methods, and a nil pointer
+is allocated. */
+func unmarshalerOf(v reflect.Value) interface{} {
+	if _, ok := v.(*reflect.PtrValue); !ok && v.Type().Name() != "" && v.CanAddr() {
+		v = v.Addr()
+	}
+
+	pv, ok := v.(*reflect.PtrValue)
+	if !ok {
+		return nil
+	}
+	switch pv.Interface().(type) {
+	case BSONUnmarshaler, Setter:
+	default:
+		return nil
+	}
+	if pv.IsNil() {
+		pv.PointTo(reflect.MakeZero(pv.Type().(*reflect.PtrType).Elem()))
+	}
+	return pv.Interface()
+}
+
+/* Collects a value for a BSONUnmarshaler or Setter, and hands it over on
+Flush. */
+type setterBuilder struct {
+	_BSONBuilder
+	value  BSON
+	target interface{}
+	sb     *structBuilder
+}
+
+func (self *setterBuilder) Flush() {
+	if self.value == nil {
+		return
+	}
+
+	var err os.Error
+	switch t := self.target.(type) {
+	case BSONUnmarshaler:
+		err = t.UnmarshalBSON(self.value)
+	case Setter:
+		err = t.SetBSON(Raw{byte(self.value.Kind()), self.value.Bytes()})
+	}
+	if err != nil && *self.sb.errp == nil {
+		*self.sb.errp = err
+	}
+
+	self.value = nil
+	self.sb.Flush()
+}
+
+/* Unmarshals the document b into val, which must be a pointer. Types with
+their own decoding, BSONUnmarshaler or Setter, are honored at any level. */
 func Unmarshal(b []byte, val interface{}) (err os.Error) {
-	sb := &structBuilder{val: reflect.NewValue(val)}
-	err = Parse(bytes.NewBuffer(b[4:len(b)]), sb)
-	return
+	switch v := val.(type) {
+	case BSONUnmarshaler:
+		doc, err := BytesToBSON(b)
+		if err != nil {
+			return err
+		}
+		return v.UnmarshalBSON(doc)
+	case Setter:
+		if _, err = BytesToBSON(b); err != nil {
+			return err
+		}
+		return v.SetBSON(Raw{ObjectKind, b})
+	}
+
+	var ferr os.Error
+	sb := &structBuilder{val: reflect.NewValue(val), errp: &ferr}
+	if err = parseDocument(b, sb); err != nil {
+		return err
+	}
+	return ferr
+}
+
+/* An ordered document. Unlike a map, a Doc is marshaled with its elements in
+the given order, which matters for commands (the command name must be the
+first key) and for compound index keys.
+
+	cmd, err := Marshal(Doc{{"count", "coll"}, {"query", query}})
+*/
+type Doc []DocElem
+
+type DocElem struct {
+	Key   string
+	Value interface{}
+}
+
+/* Binary data of a given subtype. A plain []byte marshals as binary data of
+subtype BinaryGeneric. */
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+/* A timestamp used internally by MongoDB, as in the oplog: the high 32 bits
+are seconds since the epoch, the low 32 bits an increment. */
+type Timestamp int64
+
+func (self Timestamp) Seconds() int64   { return int64(uint64(self) >> 32) }
+func (self Timestamp) Increment() int32 { return int32(uint32(self)) }
+
+/* JavaScript code. Scope is nil for plain code, or the document of
+variables the code runs with. */
+type JavaScript struct {
+	Code  string
+	Scope interface{}
+}
+
+type Symbol string
+
+/* A reference to the document with id Id in the collection Namespace.
+Deprecated in favor of DBRef documents. */
+type DBPointer struct {
+	Namespace string
+	Id        []byte
+}
+
+/* Implemented by types that marshal themselves. */
+type BSONMarshaler interface {
+	MarshalBSON() (BSON, os.Error)
+}
+
+/* Implemented by types that unmarshal themselves. UnmarshalBSON is given
+the value of the element, and must copy it if it keeps it. */
+type BSONUnmarshaler interface {
+	UnmarshalBSON(BSON) os.Error
+}
+
+/* Implemented by types that marshal as another value, such as a string or
+a struct. */
+type Getter interface {
+	GetBSON() (interface{}, os.Error)
+}
+
+/* Implemented by types that unmarshal from a raw value. */
+type Setter interface {
+	SetBSON(raw Raw) os.Error
 }
 
+/* A value as found on the wire: Kind is one of the *Kind constants, and Data
+the encoding of the value, without its key. A Raw marshals as the value it
+holds, and a Raw field receives the value undecoded. */
+type Raw struct {
+	Kind byte
+	Data []byte
+}
+
+/* Decodes the value. */
+func (self Raw) BSON() (BSON, os.Error) {
+	// Wrap the value in a document {"v": value} to parse it.
+	w32 := make([]byte, _WORD32)
+	pack.PutUint32(w32, uint32(_WORD32+1+2+len(self.Data)+1))
+	buf := bytes.NewBuffer(w32)
+	buf.WriteByte(self.Kind)
+	buf.WriteString("v")
+	buf.WriteByte(0)
+	buf.Write(self.Data)
+	buf.WriteByte(0)
+
+	doc, err := BytesToBSON(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return doc.Get("v"), nil
+}
+
+/* Decodes the value into val, as Unmarshal does with documents. */
+func (self Raw) Unmarshal(val interface{}) os.Error {
+	if self.Kind != ObjectKind {
+		return os.NewError(fmt.Sprintf("can't unmarshal BSON kind %d, only documents", self.Kind))
+	}
+	return Unmarshal(self.Data, val)
+}
+
+func (self *Raw) SetBSON(raw Raw) os.Error {
+	self.Kind = raw.Kind
+	self.Data = append([]byte{}, raw.Data...)
+	return nil
+}
+
+var (
+	binaryType     = reflect.Typeof(Binary{})
+	javaScriptType = reflect.Typeof(JavaScript{})
+	dbPointerType  = reflect.Typeof(DBPointer{})
+	decimal128Type = reflect.Typeof(Decimal128{})
+)
+
 func Marshal(val interface{}) (BSON, os.Error) {
 	if val == nil {
 		return Null, nil
 	}
 
 	switch v := val.(type) {
+	case BSON:
+		return v, nil
+	case BSONMarshaler:
+		return v.MarshalBSON()
+	case Getter:
+		g, err := v.GetBSON()
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(g)
+	case Raw:
+		return v.BSON()
+	case Doc:
+		o := newObject()
+		for _, e := range v {
+			el, err := Marshal(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			o.Set(e.Key, el)
+		}
+		return o, nil
 	case float64:
 		return &_Number{v, _Null{}}, nil
 	case string:
@@ -289,6 +609,38 @@ func Marshal(val interface{}) (BSON, os.Error) {
 		return &_Long{int64(v), _Null{}}, nil
 	case *time.Time:
 		return &_Date{v, _Null{}}, nil
+	case []byte:
+		return &_Binary{BinaryGeneric, v, _Null{}}, nil
+	case Binary:
+		return &_Binary{v.Subtype, v.Data, _Null{}}, nil
+	case Timestamp:
+		return &_Timestamp{int64(v), _Null{}}, nil
+	case Symbol:
+		return &_Symbol{string(v), _Null{}}, nil
+	case JavaScript:
+		if v.Scope == nil {
+			return &_Code{v.Code, _Null{}}, nil
+		}
+		scope, err := Marshal(v.Scope)
+		if err != nil {
+			return nil, err
+		}
+		if scope.Kind() != ObjectKind {
+			return nil, os.NewError("JavaScript scope must be a document")
+		}
+		return &_CodeWithScope{v.Code, scope, _Null{}}, nil
+	case Decimal128:
+		return &_Decimal128{v, _Null{}}, nil
+	case ObjectId:
+		if !v.Valid() {
+			return nil, os.NewError(fmt.Sprintf("invalid ObjectId %x", []byte(v)))
+		}
+		return &_OID{v, _Null{}}, nil
+	case DBPointer:
+		if len(v.Id) != 12 {
+			return nil, os.NewError("DBPointer id must have 12 bytes")
+		}
+		return &_DBPointer{v.Namespace, v.Id, _Null{}}, nil
 	}
 
 	var value reflect.Value
@@ -301,44 +653,69 @@ func Marshal(val interface{}) (BSON, os.Error) {
 
 	switch fv := value.(type) {
 	case *reflect.StructValue:
-		o := &_Object{map[string]BSON{}, _Null{}}
-		t := fv.Type().(*reflect.StructType)
-		for i := 0; i < t.NumField(); i++ {
-			key := strings.ToLower(t.Field(i).Name)
-			el, err := Marshal(fv.Field(i).Interface())
+		info, err := getStructInfo(fv.Type().(*reflect.StructType))
+		if err != nil {
+			return nil, err
+		}
+
+		o := newObject()
+		for _, f := range info.fields {
+			v := fieldByIndex(fv, f.index)
+			if f.omitEmpty && isEmpty(v) {
+				continue
+			}
+			el, err := Marshal(marshaledValue(v))
 			if err != nil {
 				return nil, err
 			}
-			// MongoDB uses '_id' as the primary key, but this
-			// name is private in Go. Use 'Id_' for this purpose
-			// instead.
-			if key == "id_" {
-				key = "_id"
+			if f.minSize && el.Kind() == LongKind && int64(int32(el.Long())) == el.Long() {
+				el = &_Int{int32(el.Long()), _Null{}}
+			}
+			o.Set(f.key, el)
+		}
+
+		if info.inlineMap != nil {
+			m, err := Marshal(fieldByIndex(fv, info.inlineMap).Interface())
+			if err != nil {
+				return nil, err
+			}
+			if m, ok := m.(*_Object); ok {
+				for _, k := range m.keys {
+					if info.field(k) != nil {
+						return nil, os.NewError(fmt.Sprintf("key %q of inline map is also a field of %v", k, fv.Type()))
+					}
+					o.Set(k, m.value[k])
+				}
 			}
-			o.value[key] = el
 		}
 		return o, nil
 	case *reflect.MapValue:
-		o := &_Object{map[string]BSON{}, _Null{}}
+		o := newObject()
 		mt := fv.Type().(*reflect.MapType)
 		if mt.Key() != reflect.Typeof("") {
 			return nil, os.NewError("can't marshall maps with non-string key types")
 		}
 
+		// Maps have no order; sort the keys so the output is stable.
 		keys := fv.Keys()
-		for _, k := range keys {
-			sk := k.(*reflect.StringValue).Get()
-			el, err := Marshal(fv.Elem(k).Interface())
+		skeys := make([]string, len(keys))
+		for i, k := range keys {
+			skeys[i] = k.(*reflect.StringValue).Get()
+		}
+		sort.SortStrings(skeys)
+
+		for _, sk := range skeys {
+			el, err := Marshal(fv.Elem(reflect.NewValue(sk)).Interface())
 			if err != nil {
 				return nil, err
 			}
-			o.value[sk] = el
+			o.Set(sk, el)
 		}
 		return o, nil
 	case *reflect.SliceValue:
 		a := &_Array{new(vector.Vector), _Null{}}
 		for i := 0; i < fv.Len(); i++ {
-			el, err := Marshal(fv.Elem(i).Interface())
+			el, err := Marshal(marshaledValue(fv.Elem(i)))
 			if err != nil {
 				return nil, err
 			}
@@ -351,3 +728,218 @@ func Marshal(val interface{}) (BSON, os.Error) {
 
 	return nil, nil
 }
+
+/* How a struct field maps to a document element. Fields are named by their
+bson tag:
+
+	Field int `bson:"name,omitempty,minsize"`
+
+The name defaults to the lowercased field name, and Id_ to _id. A name of
+"-" skips the field. The flags are:
+
+	omitempty  skip the field if it has its zero value
+	minsize    marshal an integer as int32 if it fits
+	inline     merge the fields of a struct, or the entries of a
+	           map[string]T, into the enclosing document
+
+Fields without a tag name also match keys case-insensitively when
+unmarshaling. */
+type fieldInfo struct {
+	key       string
+	index     []int
+	tagged    bool
+	omitEmpty bool
+	minSize   bool
+}
+
+type structInfo struct {
+	fields    []fieldInfo
+	inlineMap []int // index of the inline map field, if any
+}
+
+var (
+	structInfos      = make(map[reflect.Type]*structInfo)
+	structInfosMutex sync.Mutex
+)
+
+func getStructInfo(t *reflect.StructType) (*structInfo, os.Error) {
+	structInfosMutex.Lock()
+	info, ok := structInfos[t]
+	structInfosMutex.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info = new(structInfo)
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := strings.Split(tagValue(sf.Tag, "bson"), ",", -1)
+		if tag[0] == "-" {
+			continue
+		}
+
+		f := fieldInfo{key: tag[0], index: []int{i}, tagged: tag[0] != ""}
+		inline := false
+		for _, flag := range tag[1:] {
+			switch flag {
+			case "omitempty":
+				f.omitEmpty = true
+			case "minsize":
+				f.minSize = true
+			case "inline":
+				inline = true
+			default:
+				return nil, os.NewError(fmt.Sprintf("unknown flag %q in tag of %v.%s", flag, t, sf.Name))
+			}
+		}
+
+		if inline {
+			switch ft := sf.Type.(type) {
+			case *reflect.MapType:
+				if ft.Key() != reflect.Typeof("") {
+					return nil, os.NewError(fmt.Sprintf("inline map %v.%s must have string keys", t, sf.Name))
+				}
+				if info.inlineMap != nil {
+					return nil, os.NewError(fmt.Sprintf("%v has more than one inline map", t))
+				}
+				info.inlineMap = f.index
+			case *reflect.StructType:
+				sinfo, err := getStructInfo(ft)
+				if err != nil {
+					return nil, err
+				}
+				for _, sf := range sinfo.fields {
+					if keys[sf.key] {
+						return nil, os.NewError(fmt.Sprintf("duplicate key %q in %v", sf.key, t))
+					}
+					keys[sf.key] = true
+					sf.index = append([]int{i}, sf.index...)
+					info.fields = append(info.fields, sf)
+				}
+				if sinfo.inlineMap != nil {
+					if info.inlineMap != nil {
+						return nil, os.NewError(fmt.Sprintf("%v has more than one inline map", t))
+					}
+					info.inlineMap = append([]int{i}, sinfo.inlineMap...)
+				}
+			default:
+				return nil, os.NewError(fmt.Sprintf("inline field %v.%s must be a struct or a map", t, sf.Name))
+			}
+			continue
+		}
+
+		if f.key == "" {
+			f.key = strings.ToLower(sf.Name)
+			// MongoDB uses '_id' as the primary key, but this
+			// name is private in Go. Use 'Id_' for this purpose
+			// instead.
+			if f.key == "id_" {
+				f.key = "_id"
+			}
+		}
+		if keys[f.key] {
+			return nil, os.NewError(fmt.Sprintf("duplicate key %q in %v", f.key, t))
+		}
+		keys[f.key] = true
+		info.fields = append(info.fields, f)
+	}
+
+	structInfosMutex.Lock()
+	structInfos[t] = info
+	structInfosMutex.Unlock()
+	return info, nil
+}
+
+/* Gets the field for key k: the one with that name or, failing that, an
+untagged one whose name matches case-insensitively. */
+func (self *structInfo) field(k string) *fieldInfo {
+	for i := range self.fields {
+		if self.fields[i].key == k {
+			return &self.fields[i]
+		}
+	}
+	lk := strings.ToLower(k)
+	for i := range self.fields {
+		if !self.fields[i].tagged && self.fields[i].key == lk {
+			return &self.fields[i]
+		}
+	}
+	return nil
+}
+
+/* Gets the address of v if it is addressable and only its pointer has
+MarshalBSON or GetBSON, or else v itself. */
+func marshaledValue(v reflect.Value) interface{} {
+	if _, ok := v.(*reflect.PtrValue); !ok && v.Type().Name() != "" && v.CanAddr() {
+		switch v.Addr().Interface().(type) {
+		case BSONMarshaler, Getter:
+			return v.Addr().Interface()
+		}
+	}
+	return v.Interface()
+}
+
+func fieldByIndex(v *reflect.StructValue, index []int) reflect.Value {
+	var f reflect.Value = v
+	for _, i := range index {
+		f = f.(*reflect.StructValue).Field(i)
+	}
+	return f
+}
+
+/* Gets the value for key in a struct tag such as `bson:"name" json:"n"`. */
+func tagValue(tag, key string) string {
+	prefix := key + ":\""
+	i := strings.Index(tag, prefix)
+	for i > 0 && tag[i-1] != ' ' {
+		j := strings.Index(tag[i+1:], prefix)
+		if j < 0 {
+			return ""
+		}
+		i += j + 1
+	}
+	if i < 0 {
+		return ""
+	}
+
+	// Find the closing quote, skipping escaped ones.
+	start := i + len(prefix) - 1
+	for j := start + 1; j < len(tag); j++ {
+		switch tag[j] {
+		case '\\':
+			j++
+		case '"':
+			value, err := strconv.Unquote(tag[start : j+1])
+			if err != nil {
+				return ""
+			}
+			return value
+		}
+	}
+	return ""
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v := v.(type) {
+	case *reflect.BoolValue:
+		return !v.Get()
+	case *reflect.IntValue:
+		return v.Get() == 0
+	case *reflect.UintValue:
+		return v.Get() == 0
+	case *reflect.FloatValue:
+		return v.Get() == 0
+	case *reflect.StringValue:
+		return v.Get() == ""
+	case *reflect.SliceValue:
+		return v.Len() == 0
+	case *reflect.MapValue:
+		return v.IsNil() || v.Len() == 0
+	case *reflect.PtrValue:
+		return v.IsNil()
+	case *reflect.InterfaceValue:
+		return v.IsNil()
+	}
+	return false
+}
@@ -9,8 +9,6 @@ package mongo
 
 import (
 	"os"
-	"io"
-	"io/ioutil"
 	"fmt"
 	"math"
 	"time"
@@ -39,8 +37,23 @@ const (
 	IntKind
 	TimestampKind
 	LongKind
-	MinKeyKind
-	MaxKeyKind
+	Decimal128Kind
+)
+
+const (
+	MinKeyKind = 0xFF
+	MaxKeyKind = 0x7F
+)
+
+// Binary subtypes
+const (
+	BinaryGeneric  = 0x00
+	BinaryFunction = 0x01
+	BinaryOld      = 0x02 // deprecated; data is prefixed with its length
+	BinaryUUIDOld  = 0x03
+	BinaryUUID     = 0x04
+	BinaryMD5      = 0x05
+	BinaryUser     = 0x80
 )
 
 type BSON interface {
@@ -53,6 +66,11 @@ type BSON interface {
 	Regex() (string, string)
 	Int() int32
 	Long() int64
+	Binary() (byte, []byte)
+	Timestamp() int64
+	Code() (string, BSON)
+	DBPointer() (string, []byte)
+	Decimal128() Decimal128
 
 	Get(s string) BSON
 	Elem(i int) BSON
@@ -74,10 +92,17 @@ func (*_Null) Date() *time.Time        { return nil }
 func (*_Null) Regex() (string, string) { return "", "" }
 func (*_Null) Int() int32              { return 0 }
 func (*_Null) Long() int64             { return 0 }
-func (*_Null) Get(string) BSON         { return Null }
-func (*_Null) Elem(int) BSON           { return Null }
-func (*_Null) Len() int                { return 0 }
-func (*_Null) Bytes() []byte           { return []byte{0} }
+func (*_Null) Binary() (byte, []byte)  { return 0, nil }
+func (*_Null) Timestamp() int64        { return 0 }
+func (*_Null) Code() (string, BSON)    { return "", Null }
+func (*_Null) DBPointer() (string, []byte) {
+	return "", nil
+}
+func (*_Null) Decimal128() Decimal128 { return Decimal128NaN }
+func (*_Null) Get(string) BSON { return Null }
+func (*_Null) Elem(int) BSON   { return Null }
+func (*_Null) Len() int        { return 0 }
+func (*_Null) Bytes() []byte   { return []byte{} }
 
 type _Number struct {
 	value float64
@@ -113,10 +138,13 @@ func (self *_String) Bytes() []byte {
 }
 
 type _Object struct {
+	keys  []string // keys in document order
 	value map[string]BSON
 	_Null
 }
 
+func newObject() *_Object { return &_Object{nil, make(map[string]BSON), _Null{}} }
+
 func (self *_Object) Kind() int { return ObjectKind }
 func (self *_Object) Get(s string) BSON {
 	if self.value == nil {
@@ -130,10 +158,11 @@ func (self *_Object) Get(s string) BSON {
 
 	return b
 }
-func (self *_Object) Len() int { return len(self.value) }
+func (self *_Object) Len() int { return len(self.keys) }
 func (self *_Object) Bytes() []byte {
 	buf := bytes.NewBuffer([]byte{})
-	for k, v := range self.value {
+	for _, k := range self.keys {
+		v := self.value[k]
 		buf.WriteByte(byte(v.Kind()))
 		buf.WriteString(k)
 		buf.WriteByte(0)
@@ -147,7 +176,16 @@ func (self *_Object) Bytes() []byte {
 	return append(w32, buf.Bytes()...)
 }
 
-var EmptyObject BSON = &_Object{map[string]BSON{}, _Null{}}
+/* Sets the value of key. A new key is appended at the end of the document;
+an existing one keeps its position. */
+func (self *_Object) Set(key string, b BSON) {
+	if _, ok := self.value[key]; !ok {
+		self.keys = append(self.keys, key)
+	}
+	self.value[key] = b
+}
+
+var EmptyObject BSON = newObject()
 
 type _Array struct {
 	value *vector.Vector
@@ -263,6 +301,127 @@ func (self *_Long) Bytes() []byte {
 	return w64
 }
 
+type _Binary struct {
+	subtype byte
+	value   []byte
+	_Null
+}
+
+func (self *_Binary) Kind() int              { return BinaryKind }
+func (self *_Binary) Binary() (byte, []byte) { return self.subtype, self.value }
+func (self *_Binary) Bytes() []byte {
+	data := self.value
+	if self.subtype == BinaryOld {
+		w32 := make([]byte, _WORD32)
+		pack.PutUint32(w32, uint32(len(data)))
+		data = append(w32, data...)
+	}
+
+	w32 := make([]byte, _WORD32)
+	pack.PutUint32(w32, uint32(len(data)))
+	buf := bytes.NewBuffer(w32)
+	buf.WriteByte(self.subtype)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+type _Undefined struct {
+	_Null
+}
+
+var Undefined BSON = &_Undefined{}
+
+func (*_Undefined) Kind() int { return UndefinedKind }
+
+/* A timestamp used internally by MongoDB, as in the oplog: the high 32 bits
+are seconds since the epoch, the low 32 bits an increment. */
+type _Timestamp struct {
+	value int64
+	_Null
+}
+
+func (self *_Timestamp) Kind() int        { return TimestampKind }
+func (self *_Timestamp) Timestamp() int64 { return self.value }
+func (self *_Timestamp) Bytes() []byte {
+	w64 := make([]byte, _WORD64)
+	pack.PutUint64(w64, uint64(self.value))
+	return w64
+}
+
+type _MinKey struct {
+	_Null
+}
+
+var MinKey BSON = &_MinKey{}
+
+func (*_MinKey) Kind() int { return MinKeyKind }
+
+type _MaxKey struct {
+	_Null
+}
+
+var MaxKey BSON = &_MaxKey{}
+
+func (*_MaxKey) Kind() int { return MaxKeyKind }
+
+type _Code struct {
+	value string
+	_Null
+}
+
+func (self *_Code) Kind() int            { return CodeKind }
+func (self *_Code) Code() (string, BSON) { return self.value, Null }
+func (self *_Code) String() string       { return self.value }
+func (self *_Code) Bytes() []byte        { return (&_String{self.value, _Null{}}).Bytes() }
+
+type _Symbol struct {
+	value string
+	_Null
+}
+
+func (self *_Symbol) Kind() int      { return SymbolKind }
+func (self *_Symbol) String() string { return self.value }
+func (self *_Symbol) Bytes() []byte  { return (&_String{self.value, _Null{}}).Bytes() }
+
+type _CodeWithScope struct {
+	code  string
+	scope BSON
+	_Null
+}
+
+func (self *_CodeWithScope) Kind() int            { return CodeWithScope }
+func (self *_CodeWithScope) Code() (string, BSON) { return self.code, self.scope }
+func (self *_CodeWithScope) String() string       { return self.code }
+func (self *_CodeWithScope) Bytes() []byte {
+	code := (&_String{self.code, _Null{}}).Bytes()
+	scope := self.scope.Bytes()
+
+	w32 := make([]byte, _WORD32)
+	pack.PutUint32(w32, uint32(_WORD32+len(code)+len(scope)))
+	buf := bytes.NewBuffer(w32)
+	buf.Write(code)
+	buf.Write(scope)
+	return buf.Bytes()
+}
+
+/* A reference to a document in another collection. Deprecated in favor of
+DBRef documents. */
+type _DBPointer struct {
+	namespace string
+	oid       []byte
+	_Null
+}
+
+func (self *_DBPointer) Kind() int { return RefKind }
+func (self *_DBPointer) DBPointer() (string, []byte) {
+	return self.namespace, self.oid
+}
+func (self *_DBPointer) Bytes() []byte {
+	buf := bytes.NewBuffer((&_String{self.namespace, _Null{}}).Bytes())
+	buf.Write(self.oid)
+	return buf.Bytes()
+}
+
 func Equal(a, b BSON) bool {
 	switch {
 	case a == nil && b == nil:
@@ -279,12 +438,13 @@ func Equal(a, b BSON) bool {
 	case StringKind:
 		return a.String() == b.String()
 	case ObjectKind:
-		obj := a.(*_Object).value
-		if len(obj) != len(b.(*_Object).value) {
+		ao, bo := a.(*_Object), b.(*_Object)
+		if len(ao.keys) != len(bo.keys) {
 			return false
 		}
-		for k, v := range obj {
-			if !Equal(v, b.Get(k)) {
+		// Documents are ordered: same keys in another order are not equal.
+		for i, k := range ao.keys {
+			if bo.keys[i] != k || !Equal(ao.value[k], bo.value[k]) {
 				return false
 			}
 		}
@@ -313,6 +473,24 @@ func Equal(a, b BSON) bool {
 		return a.Int() == b.Int()
 	case LongKind:
 		return a.Long() == b.Long()
+	case BinaryKind:
+		as, ad := a.Binary()
+		bs, bd := b.Binary()
+		return as == bs && bytes.Equal(ad, bd)
+	case TimestampKind:
+		return a.Timestamp() == b.Timestamp()
+	case SymbolKind:
+		return a.String() == b.String()
+	case CodeKind, CodeWithScope:
+		ac, as := a.Code()
+		bc, bs := b.Code()
+		return ac == bc && Equal(as, bs)
+	case RefKind:
+		an, ao := a.DBPointer()
+		bn, bo := b.DBPointer()
+		return an == bn && bytes.Equal(ao, bo)
+	case Decimal128Kind:
+		return a.Decimal128().Equal(b.Decimal128())
 	}
 	return true
 
@@ -331,6 +509,16 @@ type Builder interface {
 	Null()
 	Object()
 	Array()
+	Binary(subtype byte, data []byte)
+	Timestamp(ts int64)
+	Code(code string)
+	CodeWithScope(code string, scope BSON)
+	Symbol(s string)
+	DBPointer(namespace string, oid []byte)
+	Undefined()
+	MinKey()
+	MaxKey()
+	Decimal128(d Decimal128)
 
 	// Create sub-Builders
 	Key(s string) Builder
@@ -346,7 +534,7 @@ type _BSONBuilder struct {
 	arr  *vector.Vector
 	elem int
 
-	obj map[string]BSON
+	obj *_Object
 	key string
 }
 
@@ -357,7 +545,7 @@ func (self *_BSONBuilder) Put(b BSON) {
 	case self.arr != nil:
 		self.arr.Set(self.elem, b)
 	case self.obj != nil:
-		self.obj[self.key] = b
+		self.obj.Set(self.key, b)
 	}
 }
 
@@ -368,14 +556,14 @@ func (self *_BSONBuilder) Get() BSON {
 	case self.arr != nil:
 		return self.arr.At(self.elem).(BSON)
 	case self.obj != nil:
-		return self.obj[self.key]
+		return self.obj.value[self.key]
 	}
 	return nil
 }
 
 func (self *_BSONBuilder) Float64(f float64) { self.Put(&_Number{f, _Null{}}) }
 func (self *_BSONBuilder) String(s string)   { self.Put(&_String{s, _Null{}}) }
-func (self *_BSONBuilder) Object()           { self.Put(&_Object{make(map[string]BSON), _Null{}}) }
+func (self *_BSONBuilder) Object()           { self.Put(newObject()) }
 func (self *_BSONBuilder) Array()            { self.Put(&_Array{new(vector.Vector), _Null{}}) }
 func (self *_BSONBuilder) Bool(b bool)       { self.Put(&_Boolean{b, _Null{}}) }
 func (self *_BSONBuilder) Date(t *time.Time) { self.Put(&_Date{t, _Null{}}) }
@@ -386,14 +574,32 @@ func (self *_BSONBuilder) Regex(regex, options string) {
 func (self *_BSONBuilder) Int32(i int32) { self.Put(&_Int{i, _Null{}}) }
 func (self *_BSONBuilder) Int64(i int64) { self.Put(&_Long{i, _Null{}}) }
 func (self *_BSONBuilder) OID(o []byte)  { self.Put(&_OID{o, _Null{}}) }
+func (self *_BSONBuilder) Binary(subtype byte, data []byte) {
+	self.Put(&_Binary{subtype, data, _Null{}})
+}
+func (self *_BSONBuilder) Timestamp(ts int64) { self.Put(&_Timestamp{ts, _Null{}}) }
+func (self *_BSONBuilder) Code(code string)   { self.Put(&_Code{code, _Null{}}) }
+func (self *_BSONBuilder) CodeWithScope(code string, scope BSON) {
+	self.Put(&_CodeWithScope{code, scope, _Null{}})
+}
+func (self *_BSONBuilder) Symbol(s string) { self.Put(&_Symbol{s, _Null{}}) }
+func (self *_BSONBuilder) DBPointer(namespace string, oid []byte) {
+	self.Put(&_DBPointer{namespace, oid, _Null{}})
+}
+func (self *_BSONBuilder) Undefined() { self.Put(Undefined) }
+func (self *_BSONBuilder) MinKey()    { self.Put(MinKey) }
+func (self *_BSONBuilder) MaxKey()    { self.Put(MaxKey) }
+func (self *_BSONBuilder) Decimal128(d Decimal128) {
+	self.Put(&_Decimal128{d, _Null{}})
+}
 
 func (self *_BSONBuilder) Key(key string) Builder {
 	bb2 := new(_BSONBuilder)
 	switch obj := self.Get().(type) {
 	case *_Object:
-		bb2.obj = obj.value
+		bb2.obj = obj
 		bb2.key = key
-		bb2.obj[key] = Null
+		obj.Set(key, Null)
 	case *_Array:
 		bb2.arr = obj.value
 		elem, _ := strconv.Atoi(key)
@@ -422,87 +628,287 @@ func BytesToBSON(b []byte) (BSON, os.Error) {
 	bb := new(_BSONBuilder)
 	bb.ptr = &bson
 	bb.Object()
-	err := Parse(bytes.NewBuffer(b[4:len(b)]), bb)
+	err := parseDocument(b, bb)
 	return bson, err
 }
 
-func readCString(buf *bytes.Buffer) string {
-	out := bytes.NewBuffer([]byte{})
-	var c byte
-	for c, _ = buf.ReadByte(); c != 0; c, _ = buf.ReadByte() {
-		out.WriteByte(c)
+var (
+	errTruncated     = os.NewError("truncated BSON document")
+	errNoTerminator  = os.NewError("missing BSON document terminator")
+	errTrailingBytes = os.NewError("trailing bytes after BSON document")
+)
+
+/* Parses a whole document, including its length prefix. */
+func parseDocument(b []byte, builder Builder) os.Error {
+	if len(b) < 5 {
+		return errTruncated
+	}
+	if l := pack.Uint32(b[0:4]); l != uint32(len(b)) {
+		return os.NewError(fmt.Sprintf("BSON document length is %d, have %d bytes", l, len(b)))
+	}
+
+	buf := bytes.NewBuffer(b[4:])
+	if err := Parse(buf, builder); err != nil {
+		return err
+	}
+	if buf.Len() > 0 {
+		return errTrailingBytes
+	}
+
+	return nil
+}
+
+func readBytes(buf *bytes.Buffer, n int) ([]byte, os.Error) {
+	if n < 0 || buf.Len() < n {
+		return nil, errTruncated
+	}
+	return buf.Next(n), nil
+}
+
+func readInt32(buf *bytes.Buffer) (int32, os.Error) {
+	bits, err := readBytes(buf, _WORD32)
+	if err != nil {
+		return 0, err
+	}
+	return int32(pack.Uint32(bits)), nil
+}
+
+func readInt64(buf *bytes.Buffer) (int64, os.Error) {
+	bits, err := readBytes(buf, _WORD64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(pack.Uint64(bits)), nil
+}
+
+func readCString(buf *bytes.Buffer) (string, os.Error) {
+	i := bytes.IndexByte(buf.Bytes(), 0)
+	if i < 0 {
+		return "", os.NewError("missing BSON cstring terminator")
+	}
+
+	s := string(buf.Next(i))
+	buf.ReadByte()
+	return s, nil
+}
+
+func readString(buf *bytes.Buffer) (string, os.Error) {
+	l, err := readInt32(buf)
+	if err != nil {
+		return "", err
+	}
+	if l < 1 || int(l) > buf.Len() {
+		return "", os.NewError(fmt.Sprintf("bad BSON string length %d", l))
 	}
 
-	return out.String()
+	s := buf.Next(int(l))
+	if s[l-1] != 0 {
+		return "", os.NewError("missing BSON string terminator")
+	}
+	return string(s[0 : l-1]), nil
 }
 
-func Parse(buf *bytes.Buffer, builder Builder) (err os.Error) {
-	kind, _ := buf.ReadByte()
-	err = nil
+/* Gets the contents of an embedded document, without its length prefix. */
+func readDocument(buf *bytes.Buffer) (*bytes.Buffer, os.Error) {
+	l, err := readInt32(buf)
+	if err != nil {
+		return nil, err
+	}
+	if l < 5 || int(l)-4 > buf.Len() {
+		return nil, os.NewError(fmt.Sprintf("bad BSON document length %d", l))
+	}
 
-	for kind != EOOKind {
-		name := readCString(buf)
-		// MongoDB uses '_id' as the primary key, but this
-		// name is private in Go. Use 'Id_' for this purpose
-		// instead.
-		if name == "_id" {
-			name = "id_"
+	return bytes.NewBuffer(buf.Next(int(l) - 4)), nil
+}
+
+/* Parses the elements of a document, up to its terminator. The document
+length prefix must have been read already. */
+func Parse(buf *bytes.Buffer, builder Builder) os.Error {
+	for {
+		kind, err := buf.ReadByte()
+		if err != nil {
+			return errNoTerminator
+		}
+		if kind == EOOKind {
+			return nil
+		}
+
+		name, err := readCString(buf)
+		if err != nil {
+			return err
 		}
 		b2 := builder.Key(name)
 
-		switch kind {
-		case NumberKind:
-			lr := io.LimitReader(buf, 8)
-			bits, _ := ioutil.ReadAll(lr)
-			ui64 := pack.Uint64(bits)
-			fl64 := math.Float64frombits(ui64)
-			b2.Float64(fl64)
-		case StringKind:
-			bits, _ := ioutil.ReadAll(io.LimitReader(buf, 4))
-			l := pack.Uint32(bits)
-			s, _ := ioutil.ReadAll(io.LimitReader(buf, int64(l-1)))
-			buf.ReadByte()
-			b2.String(string(s))
-		case ObjectKind:
+		if err = parseValue(buf, int(kind), b2); err != nil {
+			return err
+		}
+		b2.Flush()
+	}
+
+	panic("unreachable")
+}
+
+func parseValue(buf *bytes.Buffer, kind int, b2 Builder) os.Error {
+	switch kind {
+	case NumberKind:
+		ui64, err := readInt64(buf)
+		if err != nil {
+			return err
+		}
+		b2.Float64(math.Float64frombits(uint64(ui64)))
+	case StringKind:
+		s, err := readString(buf)
+		if err != nil {
+			return err
+		}
+		b2.String(s)
+	case ObjectKind, ArrayKind:
+		sub, err := readDocument(buf)
+		if err != nil {
+			return err
+		}
+		if kind == ObjectKind {
 			b2.Object()
-			ioutil.ReadAll(io.LimitReader(buf, 4))
-			err = Parse(buf, b2)
-		case ArrayKind:
+		} else {
 			b2.Array()
-			ioutil.ReadAll(io.LimitReader(buf, 4))
-			err = Parse(buf, b2)
-		case OIDKind:
-			oid, _ := ioutil.ReadAll(io.LimitReader(buf, 12))
-			b2.OID(oid)
-		case BooleanKind:
-			b, _ := buf.ReadByte()
-			if b == 1 {
-				b2.Bool(true)
-			} else {
-				b2.Bool(false)
+		}
+		if err = Parse(sub, b2); err != nil {
+			return err
+		}
+		if sub.Len() > 0 {
+			return errTrailingBytes
+		}
+	case OIDKind:
+		oid, err := readBytes(buf, 12)
+		if err != nil {
+			return err
+		}
+		b2.OID(append([]byte{}, oid...))
+	case BooleanKind:
+		b, err := buf.ReadByte()
+		if err != nil {
+			return errTruncated
+		}
+		b2.Bool(b == 1)
+	case DateKind:
+		ms, err := readInt64(buf)
+		if err != nil {
+			return err
+		}
+		b2.Date(time.SecondsToUTC(ms / 1000))
+	case NullKind:
+		b2.Null()
+	case RegexKind:
+		regex, err := readCString(buf)
+		if err != nil {
+			return err
+		}
+		options, err := readCString(buf)
+		if err != nil {
+			return err
+		}
+		b2.Regex(regex, options)
+	case IntKind:
+		i32, err := readInt32(buf)
+		if err != nil {
+			return err
+		}
+		b2.Int32(i32)
+	case LongKind:
+		i64, err := readInt64(buf)
+		if err != nil {
+			return err
+		}
+		b2.Int64(i64)
+	case BinaryKind:
+		l, err := readInt32(buf)
+		if err != nil {
+			return err
+		}
+		subtype, err := buf.ReadByte()
+		if err != nil {
+			return errTruncated
+		}
+		data, err := readBytes(buf, int(l))
+		if err != nil {
+			return err
+		}
+		if subtype == BinaryOld {
+			if len(data) < _WORD32 || int(pack.Uint32(data[0:4])) != len(data)-_WORD32 {
+				return os.NewError("bad length of old binary data")
 			}
-		case DateKind:
-			bits, _ := ioutil.ReadAll(io.LimitReader(buf, 8))
-			ui64 := pack.Uint64(bits)
-			b2.Date(time.SecondsToUTC(int64(ui64) / 1000))
-		case RegexKind:
-			regex := readCString(buf)
-			options := readCString(buf)
-			b2.Regex(regex, options)
-		case IntKind:
-			bits, _ := ioutil.ReadAll(io.LimitReader(buf, 4))
-			ui32 := pack.Uint32(bits)
-			b2.Int32(int32(ui32))
-		case LongKind:
-			bits, _ := ioutil.ReadAll(io.LimitReader(buf, 8))
-			ui64 := pack.Uint64(bits)
-			b2.Int64(int64(ui64))
-		default:
-			err = os.NewError(fmt.Sprintf("don't know how to handle kind %v yet", kind))
-		}
-
-		kind, _ = buf.ReadByte()
+			data = data[_WORD32:]
+		}
+		// Don't keep a reference to the whole reply.
+		b2.Binary(subtype, append([]byte{}, data...))
+	case UndefinedKind:
+		b2.Undefined()
+	case TimestampKind:
+		ts, err := readInt64(buf)
+		if err != nil {
+			return err
+		}
+		b2.Timestamp(ts)
+	case MinKeyKind:
+		b2.MinKey()
+	case MaxKeyKind:
+		b2.MaxKey()
+	case CodeKind:
+		code, err := readString(buf)
+		if err != nil {
+			return err
+		}
+		b2.Code(code)
+	case SymbolKind:
+		s, err := readString(buf)
+		if err != nil {
+			return err
+		}
+		b2.Symbol(s)
+	case CodeWithScope:
+		l, err := readInt32(buf)
+		if err != nil {
+			return err
+		}
+		if l < 14 || int(l)-4 > buf.Len() {
+			return os.NewError(fmt.Sprintf("bad BSON code with scope length %d", l))
+		}
+		sub := bytes.NewBuffer(buf.Next(int(l) - 4))
+		code, err := readString(sub)
+		if err != nil {
+			return err
+		}
+		var scope BSON
+		bb := new(_BSONBuilder)
+		bb.ptr = &scope
+		bb.Object()
+		if err = parseDocument(sub.Bytes(), bb); err != nil {
+			return err
+		}
+		b2.CodeWithScope(code, scope)
+	case RefKind:
+		namespace, err := readString(buf)
+		if err != nil {
+			return err
+		}
+		oid, err := readBytes(buf, 12)
+		if err != nil {
+			return err
+		}
+		b2.DBPointer(namespace, append([]byte{}, oid...))
+	case Decimal128Kind:
+		l, err := readInt64(buf)
+		if err != nil {
+			return err
+		}
+		h, err := readInt64(buf)
+		if err != nil {
+			return err
+		}
+		b2.Decimal128(Decimal128{uint64(h), uint64(l)})
+	default:
+		return os.NewError(fmt.Sprintf("don't know how to handle kind %v yet", kind))
 	}
 
-	return
+	return nil
 }
@@ -5,8 +5,11 @@
 package mongo
 
 import (
+	"big"
+	"bytes"
 	"testing"
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -81,11 +84,19 @@ func TestMarshal(t *testing.T) {
 	Unmarshal(b, &es1)
 	bs1, _ := Marshal(&es1)
 	bs2, _ := BytesToBSON(b)
-	assertTrue(Equal(bs1, bs2), "unmarshal->marshal", t)
+	// Marshal keeps the order of the struct fields.
+	inOrder, _ := Marshal(Doc{
+		{"first", bs2.Get("first")},
+		{"second", bs2.Get("second")},
+		{"third", bs2.Get("third")},
+		{"fourth", bs2.Get("fourth")},
+		{"fifth", Doc{{"f", "i"}, {"v", "e"}}},
+	})
+	assertTrue(Equal(bs1, inOrder), "unmarshal->marshal", t)
 
-	m := map[string]string{"f": "i", "v": "e"}
+	m := map[string]string{"v": "e", "f": "i"}
 	bs3, _ := Marshal(&m)
-	assertTrue(Equal(bs3, bs2.Get("fifth")), "marshal map", t)
+	assertTrue(Equal(bs3, inOrder.Get("fifth")), "marshal map", t)
 
 	arr, _ := Marshal([]int{1, 2, 3})
 	assertTrue(arr.Elem(0).Long() == 1, "array marshal (0)", t)
@@ -100,3 +111,366 @@ func TestMarshal(t *testing.T) {
 	Unmarshal(bs2.Bytes(), es2)
 	assertTrue(es2.Date.Seconds() == d.Seconds(), "date unmarshal", t)
 }
+
+func TestOrderedDocument(t *testing.T) {
+	obj, err := BytesToBSON(b)
+	assertTrue(err == nil, "failed parsing", t)
+	assertTrue(bytes.Equal(obj.Bytes(), b), "round trip is not byte-identical", t)
+
+	doc, err := Marshal(Doc{{"count", "coll"}, {"query", EmptyObject}, {"limit", int32(1)}})
+	assertTrue(err == nil, "cannot marshal Doc", t)
+	assertTrue(doc.Len() == 3, "Doc length", t)
+	want := []byte{
+		44, 0, 0, 0,
+		2, 'c', 'o', 'u', 'n', 't', 0, 5, 0, 0, 0, 'c', 'o', 'l', 'l', 0,
+		3, 'q', 'u', 'e', 'r', 'y', 0, 5, 0, 0, 0, 0,
+		16, 'l', 'i', 'm', 'i', 't', 0, 1, 0, 0, 0,
+		0,
+	}
+	assertTrue(bytes.Equal(doc.Bytes(), want), fmt.Sprintf("Doc order not kept: %v", doc.Bytes()), t)
+
+	ab, _ := Marshal(Doc{{"a", 1}, {"b", 2}})
+	ba, _ := Marshal(Doc{{"b", 2}, {"a", 1}})
+	assertTrue(!Equal(ab, ba), "Equal ignores key order", t)
+}
+
+func TestParseCorruptDocuments(t *testing.T) {
+	bad := map[string][]byte{
+		"empty":              []byte{},
+		"short":              []byte{5, 0, 0},
+		"wrong length":       []byte{6, 0, 0, 0, 0},
+		"no terminator":      []byte{5, 0, 0, 0, 16},
+		"unterminated key":   []byte{7, 0, 0, 0, 16, 'a', 'b'},
+		"missing value":      []byte{8, 0, 0, 0, 16, 'a', 'b', 0},
+		"truncated int":      []byte{10, 0, 0, 0, 16, 'a', 0, 1, 0, 0},
+		"negative string":    []byte{13, 0, 0, 0, 2, 'a', 0, 255, 255, 255, 255, 0, 0},
+		"long string":        []byte{15, 0, 0, 0, 2, 'a', 0, 100, 0, 0, 0, 'b', 0, 0, 0},
+		"unterminated value": []byte{14, 0, 0, 0, 2, 'a', 0, 2, 0, 0, 0, 'b', 'c', 0},
+		"bad subdocument":    []byte{13, 0, 0, 0, 3, 'a', 0, 200, 0, 0, 0, 0, 0},
+		"trailing bytes":     []byte{7, 0, 0, 0, 0, 0, 0},
+	}
+
+	for name, doc := range bad {
+		_, err := BytesToBSON(doc)
+		assertTrue(err != nil, "parsed corrupt document: "+name, t)
+		var es ExampleStruct
+		err = Unmarshal(doc, &es)
+		assertTrue(err != nil, "unmarshaled corrupt document: "+name, t)
+	}
+}
+
+type AllTypes struct {
+	Data    []byte
+	Bin     Binary
+	Ts      Timestamp
+	Js      string
+	Scoped  JavaScript
+	Sym     Symbol
+	Pointer DBPointer
+}
+
+func TestAllKinds(t *testing.T) {
+	oid := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	doc, err := Marshal(Doc{
+		{"data", []byte{1, 2, 3}},
+		{"bin", Binary{BinaryUUID, []byte{4, 5}}},
+		{"old", Binary{BinaryOld, []byte{6}}},
+		{"ts", Timestamp(5<<32 | 7)},
+		{"js", JavaScript{"return 1;", nil}},
+		{"scoped", JavaScript{"return x;", Doc{{"x", 1}}}},
+		{"sym", Symbol("sym")},
+		{"pointer", DBPointer{"db.coll", oid}},
+		{"undefined", Undefined},
+		{"min", MinKey},
+		{"max", MaxKey},
+		{"null", Null},
+	})
+	assertTrue(err == nil, fmt.Sprintf("cannot marshal: %v", err), t)
+
+	parsed, err := BytesToBSON(doc.Bytes())
+	assertTrue(err == nil, fmt.Sprintf("cannot parse: %v", err), t)
+	assertTrue(Equal(doc, parsed), "round trip", t)
+	assertTrue(bytes.Equal(doc.Bytes(), parsed.Bytes()), "round trip is not byte-identical", t)
+
+	kinds := map[string]int{
+		"data": BinaryKind, "bin": BinaryKind, "old": BinaryKind, "ts": TimestampKind,
+		"js": CodeKind, "scoped": CodeWithScope, "sym": SymbolKind, "pointer": RefKind,
+		"undefined": UndefinedKind, "min": MinKeyKind, "max": MaxKeyKind, "null": NullKind,
+	}
+	for k, kind := range kinds {
+		assertTrue(parsed.Get(k).Kind() == kind, "kind of "+k, t)
+	}
+
+	subtype, data := parsed.Get("bin").Binary()
+	assertTrue(subtype == BinaryUUID && bytes.Equal(data, []byte{4, 5}), "binary", t)
+	_, data = parsed.Get("old").Binary()
+	assertTrue(bytes.Equal(data, []byte{6}), "old binary", t)
+	assertTrue(Timestamp(parsed.Get("ts").Timestamp()).Seconds() == 5, "timestamp seconds", t)
+	assertTrue(Timestamp(parsed.Get("ts").Timestamp()).Increment() == 7, "timestamp increment", t)
+	code, scope := parsed.Get("scoped").Code()
+	assertTrue(code == "return x;" && scope.Get("x").Long() == 1, "code with scope", t)
+	ns, id := parsed.Get("pointer").DBPointer()
+	assertTrue(ns == "db.coll" && bytes.Equal(id, oid), "db pointer", t)
+
+	var all AllTypes
+	err = Unmarshal(doc.Bytes(), &all)
+	assertTrue(err == nil, fmt.Sprintf("cannot unmarshal: %v", err), t)
+	assertTrue(bytes.Equal(all.Data, []byte{1, 2, 3}), "unmarshal []byte", t)
+	assertTrue(all.Bin.Subtype == BinaryUUID && bytes.Equal(all.Bin.Data, []byte{4, 5}), "unmarshal Binary", t)
+	assertTrue(all.Ts == Timestamp(5<<32|7), "unmarshal Timestamp", t)
+	assertTrue(all.Js == "return 1;", "unmarshal code into string", t)
+	assertTrue(all.Scoped.Code == "return x;" && all.Scoped.Scope != nil, "unmarshal JavaScript", t)
+	assertTrue(all.Sym == "sym", "unmarshal Symbol", t)
+	assertTrue(all.Pointer.Namespace == "db.coll", "unmarshal DBPointer", t)
+}
+
+func TestDecimal128(t *testing.T) {
+	cases := []struct {
+		in, out string
+		h, l    uint64
+	}{
+		{"0", "0", 0x3040000000000000, 0},
+		{"-0", "-0", 0xB040000000000000, 0},
+		{"1", "1", 0x3040000000000000, 1},
+		{"-1", "-1", 0xB040000000000000, 1},
+		{"0.1", "0.1", 0x303E000000000000, 1},
+		{"0.001234", "0.001234", 0x3034000000000000, 0x4d2},
+		{"1E+3", "1E+3", 0x3046000000000000, 1},
+		{"1e-7", "1E-7", 0x3032000000000000, 1},
+		{"-12.50", "-12.50", 0xB03C000000000000, 1250},
+		{"9999999999999999999999999999999999", "9999999999999999999999999999999999", 0x3041ED09BEAD87C0, 0x378D8E63FFFFFFFF},
+		{"Infinity", "Infinity", 0x7800000000000000, 0},
+		{"-inf", "-Infinity", 0xF800000000000000, 0},
+		{"NaN", "NaN", 0x7C00000000000000, 0},
+	}
+	for _, c := range cases {
+		d, err := ParseDecimal128(c.in)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", c.in, err)
+			continue
+		}
+		assertTrue(d.h == c.h && d.l == c.l, fmt.Sprintf("%q encoded as %x %x", c.in, d.h, d.l), t)
+		assertTrue(d.String() == c.out, fmt.Sprintf("%q formatted as %q", c.in, d.String()), t)
+	}
+
+	bad := []string{"", "-", "1.2.3", "1E", "abc", "12345678901234567890123456789012345", "1E+6200", "1E-6300"}
+	for _, s := range bad {
+		_, err := ParseDecimal128(s)
+		assertTrue(err != nil, "parsed "+s, t)
+	}
+
+	// Trailing zeros beyond 34 digits are dropped into the exponent.
+	d, err := ParseDecimal128("1000000000000000000000000000000000000")
+	assertTrue(err == nil && d.String() == "1.000000000000000000000000000000000E+36", "clamped digits", t)
+
+	a, _ := ParseDecimal128("1.0")
+	b, _ := ParseDecimal128("1.00")
+	assertTrue(a.Equal(b) && !a.Equal(Decimal128NaN) && !Decimal128NaN.Equal(Decimal128NaN), "Equal", t)
+
+	coef, exp, ok := b.BigInt()
+	assertTrue(ok && coef.String() == "100" && exp == -2, "BigInt", t)
+	d, _ = NewDecimal128(big.NewInt(-1250), -2)
+	assertTrue(d.String() == "-12.50", "NewDecimal128", t)
+
+	r, ok := d.Rat()
+	assertTrue(ok && r.String() == "-25/2", "Rat", t)
+	d, err = Decimal128FromRat(r)
+	assertTrue(err == nil && d.String() == "-12.5", "Decimal128FromRat", t)
+	_, err = Decimal128FromRat(big.NewRat(1, 3))
+	assertTrue(err != nil, "converted 1/3", t)
+
+	type Invoice struct {
+		Total Decimal128
+		Text  string
+	}
+	total, _ := ParseDecimal128("1234.56")
+	doc, _ := Marshal(Doc{{"total", total}, {"text", total}})
+	assertTrue(doc.Get("total").Kind() == Decimal128Kind, "marshal Decimal128", t)
+	var inv Invoice
+	err = Unmarshal(doc.Bytes(), &inv)
+	assertTrue(err == nil && inv.Total.Equal(total) && inv.Text == "1234.56", "unmarshal Decimal128", t)
+	parsed, _ := BytesToBSON(doc.Bytes())
+	assertTrue(Equal(doc, parsed) && bytes.Equal(doc.Bytes(), parsed.Bytes()), "Decimal128 round trip", t)
+}
+
+func TestObjectId(t *testing.T) {
+	a := NewObjectId()
+	b := NewObjectId()
+	assertTrue(a.Valid() && !bytes.Equal(a, b), "ids are not unique", t)
+	assertTrue(bytes.Equal(a[4:9], b[4:9]), "machine and pid change", t)
+	assertTrue(b[11] == a[11]+1 || b[11] == 0, "counter", t)
+
+	now := time.Seconds()
+	assertTrue(now-a.Timestamp() < 5 && now-a.Timestamp() >= 0, "timestamp", t)
+
+	id, err := ObjectIdHex("4d88e15b60f486e428412dc9")
+	assertTrue(err == nil && id.Hex() == "4d88e15b60f486e428412dc9", "hex", t)
+	assertTrue(id.Timestamp() == 0x4d88e15b, "timestamp of hex id", t)
+	assertTrue(id.String() == `ObjectIdHex("4d88e15b60f486e428412dc9")`, "String", t)
+	_, err = ObjectIdHex("4d88e15b60f486e428412dc")
+	assertTrue(err != nil, "accepted short hex", t)
+	_, err = ObjectIdHex("4d88e15b60f486e428412dcz")
+	assertTrue(err != nil, "accepted bad hex", t)
+
+	type WithObjectId struct {
+		Ref ObjectId
+	}
+	doc, err := Marshal(&WithObjectId{id})
+	assertTrue(err == nil && doc.Get("ref").Kind() == OIDKind, "marshal ObjectId", t)
+	var back WithObjectId
+	err = Unmarshal(doc.Bytes(), &back)
+	assertTrue(err == nil && bytes.Equal(back.Ref, id), "unmarshal ObjectId", t)
+	_, err = Marshal(ObjectId([]byte{1, 2}))
+	assertTrue(err != nil, "marshaled invalid ObjectId", t)
+}
+
+type TaggedBase struct {
+	Created int64 `bson:"created_at"`
+}
+
+type TaggedStruct struct {
+	Id      string            `bson:"_id"`
+	Name    string            `bson:"n" json:"name"`
+	Skipped string            `bson:"-"`
+	Note    string            `bson:",omitempty"`
+	Count   int64             `bson:"count,minsize"`
+	Base    TaggedBase        `bson:",inline"`
+	Extra   map[string]string `bson:",inline"`
+}
+
+func TestStructTags(t *testing.T) {
+	ts := TaggedStruct{Id: "x", Name: "a", Skipped: "s", Count: 3, Base: TaggedBase{7}, Extra: map[string]string{"more": "m"}}
+	doc, err := Marshal(ts)
+	assertTrue(err == nil, fmt.Sprintf("marshal: %v", err), t)
+	expected, _ := Marshal(Doc{{"_id", "x"}, {"n", "a"}, {"count", int32(3)}, {"created_at", int64(7)}, {"more", "m"}})
+	assertTrue(Equal(doc, expected), fmt.Sprintf("marshaled %v", doc), t)
+
+	ts.Note = "note"
+	ts.Count = 1 << 40
+	doc, _ = Marshal(ts)
+	assertTrue(doc.Get("note").String() == "note", "omitempty dropped a value", t)
+	assertTrue(doc.Get("count").Kind() == LongKind, "minsize truncated a long", t)
+
+	var back TaggedStruct
+	err = Unmarshal(doc.Bytes(), &back)
+	assertTrue(err == nil, fmt.Sprintf("unmarshal: %v", err), t)
+	assertTrue(back.Id == "x" && back.Name == "a" && back.Note == "note", "unmarshal tagged fields", t)
+	assertTrue(back.Skipped == "" && back.Count == 1<<40 && back.Base.Created == 7, "unmarshal skipped, minsize and inline fields", t)
+	assertTrue(back.Extra["more"] == "m" && len(back.Extra) == 1, "unmarshal inline map", t)
+
+	type Duplicate struct {
+		A string `bson:"k"`
+		B string `bson:"k"`
+	}
+	_, err = Marshal(Duplicate{})
+	assertTrue(err != nil, "marshaled duplicate keys", t)
+
+	// Raw documents keep their _id.
+	raw, _ := BytesToBSON(expected.Bytes())
+	assertTrue(raw.Get("_id").String() == "x", "_id renamed by Parse", t)
+
+	m := make(map[string]int32)
+	Unmarshal(expected.Bytes(), &m)
+	assertTrue(m["count"] == 3, "unmarshal into map", t)
+}
+
+/* Marshals as a string such as "12.50 EUR". */
+type Money struct {
+	Cents    int64
+	Currency string
+}
+
+func (self Money) MarshalBSON() (BSON, os.Error) {
+	return Marshal(fmt.Sprintf("%d.%02d %s", self.Cents/100, self.Cents%100, self.Currency))
+}
+
+func (self *Money) UnmarshalBSON(b BSON) os.Error {
+	if b.Kind() != StringKind {
+		return os.NewError("money must be a string")
+	}
+	var units, cents int64
+	_, err := fmt.Sscanf(b.String(), "%d.%d %s", &units, &cents, &self.Currency)
+	self.Cents = units*100 + cents
+	return err
+}
+
+/* Marshals as its name. */
+type Color int
+
+var colorNames = []string{"red", "green", "blue"}
+
+func (self Color) GetBSON() (interface{}, os.Error) {
+	return colorNames[self], nil
+}
+
+func (self *Color) SetBSON(raw Raw) os.Error {
+	b, err := raw.BSON()
+	if err != nil {
+		return err
+	}
+	for i, name := range colorNames {
+		if b.String() == name {
+			*self = Color(i)
+			return nil
+		}
+	}
+	return os.NewError("unknown color " + b.String())
+}
+
+func (self Money) Equal(other Money) bool {
+	return self.Cents == other.Cents && self.Currency == other.Currency
+}
+
+type Order struct {
+	Total   Money
+	Prices  []Money
+	Color   Color
+	Refund  *Money
+	Details Raw
+}
+
+func TestCustomMarshaling(t *testing.T) {
+	details, _ := Marshal(Doc{{"gift", true}})
+	order := &Order{
+		Total:   Money{1250, "EUR"},
+		Prices:  []Money{{1000, "EUR"}, {250, "EUR"}},
+		Color:   Color(2),
+		Refund:  &Money{5, "USD"},
+		Details: Raw{ObjectKind, details.Bytes()},
+	}
+
+	doc, err := Marshal(order)
+	assertTrue(err == nil, fmt.Sprintf("marshal: %v", err), t)
+	assertTrue(doc.Get("total").String() == "12.50 EUR", "MarshalBSON", t)
+	assertTrue(doc.Get("prices").Elem(1).String() == "2.50 EUR", "MarshalBSON in a slice", t)
+	assertTrue(doc.Get("color").String() == "blue", "GetBSON", t)
+	assertTrue(doc.Get("refund").String() == "0.05 USD", "MarshalBSON of a pointer", t)
+	assertTrue(doc.Get("details").Get("gift").Bool(), "Raw", t)
+
+	var back Order
+	err = Unmarshal(doc.Bytes(), &back)
+	assertTrue(err == nil, fmt.Sprintf("unmarshal: %v", err), t)
+	assertTrue(back.Total.Equal(order.Total), "UnmarshalBSON", t)
+	assertTrue(len(back.Prices) == 2 && back.Prices[1].Equal(order.Prices[1]), "UnmarshalBSON in a slice", t)
+	assertTrue(back.Color == order.Color, "SetBSON", t)
+	assertTrue(back.Refund != nil && back.Refund.Equal(*order.Refund), "UnmarshalBSON of a nil pointer", t)
+	assertTrue(back.Details.Kind == ObjectKind && bytes.Equal(back.Details.Data, details.Bytes()), "Raw field", t)
+
+	bad, _ := Marshal(Doc{{"color", "mauve"}})
+	err = Unmarshal(bad.Bytes(), &back)
+	assertTrue(err != nil, "SetBSON error not returned", t)
+
+	// Map elements, which can't be addressed, are decoded too.
+	var byName struct {
+		Prices map[string]Money
+		Colors map[string]Color
+	}
+	doc, _ = Marshal(Doc{
+		{"prices", Doc{{"tea", "2.50 EUR"}, {"cake", "4.00 EUR"}}},
+		{"colors", Doc{{"sky", "blue"}}},
+	})
+	err = Unmarshal(doc.Bytes(), &byName)
+	assertTrue(err == nil, fmt.Sprintf("unmarshal maps: %v", err), t)
+	assertTrue(byName.Prices["tea"].Equal(Money{250, "EUR"}) && byName.Prices["cake"].Equal(Money{400, "EUR"}), fmt.Sprintf("UnmarshalBSON in a map: %v", byName.Prices), t)
+	assertTrue(byName.Colors["sky"] == Color(2), "SetBSON in a map", t)
+}
@@ -0,0 +1,333 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"os"
+)
+
+
+/* A batch of writes to a collection, queued and then sent at once by Run:
+
+	bulk := coll.Bulk()
+	bulk.Insert(a, b)
+	bulk.Update(Doc{{"_id", 1}}, Doc{{"$inc", Doc{{"n", 1}}}})
+	bulk.RemoveOne(Doc{{"_id", 2}})
+	result, err := bulk.Run()
+
+An ordered bulk runs the writes one after the other and stops at the first
+that fails. It is not pipelined: each write waits for its acknowledgement
+before the next is sent, since the server would apply the writes sent after
+a failing one. An unordered one pipelines them all on a single socket,
+without waiting for each to be acknowledged, and goes on after failures.
+*/
+type Bulk struct {
+	collection *Collection
+	ordered    bool
+	ops        []*bulkOp
+	err        os.Error // first failure to queue a write
+}
+
+const (
+	bulkInsert = iota
+	bulkUpdate
+	bulkRemove
+)
+
+type bulkOp struct {
+	kind int
+	msg  message
+}
+
+/* Starts an ordered bulk of writes to the collection. */
+func (self *Collection) Bulk() *Bulk {
+	return &Bulk{collection: self, ordered: true}
+}
+
+/* Makes the bulk unordered. */
+func (self *Bulk) Unordered() {
+	self.ordered = false
+}
+
+/* Queues the insert of documents, giving those without an _id a new
+ObjectId. */
+func (self *Bulk) Insert(docs ...interface{}) {
+	for _, d := range docs {
+		doc, err := self.marshal(d)
+		if err != nil {
+			return
+		}
+		doc, _ = withId(doc)
+		self.add(bulkInsert, &opInsert{_ZERO, self.collection.fullName(), []BSON{doc}})
+	}
+}
+
+/* Queues the update of the first document matching selector. */
+func (self *Bulk) Update(selector, update interface{}) {
+	self.update(_ZERO, selector, update)
+}
+
+/* Queues the update of all the documents matching selector. */
+func (self *Bulk) UpdateAll(selector, update interface{}) {
+	self.update(fUpdateAll, selector, update)
+}
+
+/* Queues the update of the first document matching selector, or the insert
+of a new one if none matches. */
+func (self *Bulk) Upsert(selector, update interface{}) {
+	self.update(fUpsert, selector, update)
+}
+
+/* Queues the removal of all the documents matching selector. */
+func (self *Bulk) Remove(selector interface{}) {
+	self.remove(_ZERO, selector)
+}
+
+/* Queues the removal of the first document matching selector. */
+func (self *Bulk) RemoveOne(selector interface{}) {
+	self.remove(fSingleRemove, selector)
+}
+
+func (self *Bulk) update(flags int32, selector, update interface{}) {
+	s, err := self.marshal(selector)
+	if err != nil {
+		return
+	}
+	u, err := self.marshal(update)
+	if err != nil {
+		return
+	}
+	self.add(bulkUpdate, &opUpdate{self.collection.fullName(), flags, s, u})
+}
+
+func (self *Bulk) remove(flags int32, selector interface{}) {
+	s, err := self.marshal(selector)
+	if err != nil {
+		return
+	}
+	self.add(bulkRemove, &opDelete{self.collection.fullName(), flags, s})
+}
+
+func (self *Bulk) add(kind int, msg message) {
+	self.ops = append(self.ops, &bulkOp{kind, msg})
+}
+
+/* Marshals a document, keeping the first failure for Run to report. */
+func (self *Bulk) marshal(doc interface{}) (BSON, os.Error) {
+	b, err := Marshal(doc)
+	if err == nil && b.Kind() != ObjectKind {
+		err = os.NewError(fmt.Sprintf("%v is not a document", doc))
+	}
+	if err != nil && self.err == nil {
+		self.err = os.NewError(fmt.Sprintf("bulk write %d: %s", len(self.ops), err))
+	}
+	return b, err
+}
+
+
+// === Results
+// ===
+
+/* The outcome of a bulk. With an unacknowledged write concern, the counts
+are all zero. */
+type BulkResult struct {
+	Inserted int
+	Matched  int // documents matched by updates
+	Modified int // documents changed by updates; Matched if the server doesn't tell
+	Upserted int
+	Removed  int
+
+	Upserts []BulkUpsert
+	Errors  []*BulkError
+}
+
+/* A document inserted by an upsert. */
+type BulkUpsert struct {
+	Index int // of the write in the bulk
+	Id    BSON
+}
+
+/* A write of a bulk that failed. */
+type BulkError struct {
+	Index int // of the write in the bulk
+	Err   os.Error
+}
+
+func (self *BulkError) String() string {
+	return fmt.Sprintf("bulk write %d: %s", self.Index, self.Err)
+}
+
+/* The writes of a bulk that failed. */
+type BulkErrors []*BulkError
+
+func (self BulkErrors) String() string {
+	msg := fmt.Sprintf("%d bulk writes failed", len(self))
+	for _, e := range self {
+		msg += "; " + e.String()
+	}
+	return msg
+}
+
+/* Adds the getLastError reply to the write i. Returns false if the write
+failed. */
+func (self *BulkResult) add(i int, op *bulkOp, doc BSON) bool {
+	if err := lastError(doc); err != nil {
+		self.Errors = append(self.Errors, &BulkError{i, err})
+		return false
+	}
+
+	n := toInt(doc.Get("n"))
+	switch op.kind {
+	case bulkInsert:
+		self.Inserted++
+	case bulkUpdate:
+		if id := doc.Get("upserted"); id.Kind() != NullKind {
+			self.Upserted++
+			self.Upserts = append(self.Upserts, BulkUpsert{i, id})
+			break
+		}
+		self.Matched += n
+		if nModified := doc.Get("nModified"); nModified.Kind() != NullKind {
+			self.Modified += toInt(nModified)
+		} else {
+			self.Modified += n
+		}
+	case bulkRemove:
+		self.Removed += n
+	}
+	return true
+}
+
+
+// === Running
+// ===
+
+/* Sends the queued writes. The failures of single writes are in the
+result, and returned as BulkErrors; other errors, such as a network
+failure, stop the bulk. */
+func (self *Bulk) Run() (*BulkResult, os.Error) {
+	if self.err != nil {
+		return nil, self.err
+	}
+
+	conn := self.collection.db.Conn
+	pool, err := conn.primary()
+	if err != nil {
+		return nil, err
+	}
+	sock, err := pool.checkout(self.collection.db.ctx)
+	if err != nil {
+		conn.checkFailure(self.collection.db.ctx, pool, nil, err)
+		return nil, err
+	}
+	defer pool.checkin(sock)
+
+	result := new(BulkResult)
+	wc := self.collection.WriteConcern()
+	switch {
+	case !wc.acknowledged():
+		for _, op := range self.ops {
+			if err = sock.send(op.msg); err != nil {
+				return result, err
+			}
+		}
+	case self.ordered:
+		err = self.runOrdered(sock, result)
+	default:
+		err = self.runUnordered(sock, result)
+	}
+
+	conn.checkFailure(self.collection.db.ctx, pool, sock, err)
+	for _, e := range result.Errors {
+		conn.checkFailure(self.collection.db.ctx, pool, sock, e.Err)
+	}
+	if err == nil && len(result.Errors) > 0 {
+		err = BulkErrors(result.Errors)
+	}
+	return result, err
+}
+
+func (self *Bulk) gle() *opQuery {
+	wc := self.collection.WriteConcern()
+	return &opQuery{o_NONE, self.collection.db.name + ".$cmd", 0, -1, wc.command(), nil}
+}
+
+/* Sends each write and waits for its getLastError reply before the next,
+so that nothing after a failure reaches the server. */
+func (self *Bulk) runOrdered(sock *socket, result *BulkResult) os.Error {
+	gle := self.gle()
+	for i, op := range self.ops {
+		if err := sock.send(op.msg); err != nil {
+			return err
+		}
+		reply, err := sock.roundTrip(gle)
+		if err != nil {
+			return err
+		}
+		if reply.documents.Len() == 0 {
+			return os.NewError("no reply to getLastError")
+		}
+		if !result.add(i, op, reply.documents.At(0).(BSON)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+/* Sends all the writes, each followed by getLastError, while reading the
+replies. Writing and reading at once keeps both ends from blocking on full
+socket buffers. */
+func (self *Bulk) runUnordered(sock *socket, result *BulkResult) os.Error {
+	gle := self.gle()
+	reqIDs := make(chan int32, len(self.ops))
+	werr := make(chan os.Error, 1)
+
+	go func() {
+		defer close(reqIDs)
+		for _, op := range self.ops {
+			if err := sock.send(op.msg); err != nil {
+				werr <- err
+				return
+			}
+			reqID, err := sock.write(gle)
+			if err != nil {
+				werr <- err
+				return
+			}
+			reqIDs <- reqID
+		}
+		werr <- nil
+	}()
+
+	i := 0
+	for reqID := range reqIDs {
+		reply, err := sock.readReply()
+		if err == nil && reply.responseTo != reqID {
+			err = os.NewError("wrong responseTo code")
+		}
+		if err == nil {
+			err = reply.err()
+		}
+		if err == nil && reply.documents.Len() == 0 {
+			err = os.NewError("no reply to getLastError")
+		}
+		if err != nil {
+			// Hang up, which also stops the writer, and wait for it to
+			// be done with the socket before handing it back.
+			sock.conn.Close()
+			for _ = range reqIDs {
+			}
+			<-werr
+			sock.dead = true
+			return err
+		}
+
+		result.add(i, self.ops[i], reply.documents.At(0).(BSON))
+		i++
+	}
+
+	return <-werr
+}
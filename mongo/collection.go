@@ -5,14 +5,17 @@
 package mongo
 
 import (
+	"fmt"
 	"os"
-	"rand"
 )
 
 
 type Collection struct {
 	db   *Database
 	name string
+
+	writeConcern   *WriteConcern
+	readPreference *ReadPreference
 }
 
 func (self *Collection) Drop() os.Error {
@@ -30,31 +33,6 @@ func (self *Collection) fullName() string {
 	return self.db.name + "." + self.name
 }
 
-// === Client Request Messages
-// ===
-
-func (self *Connection) sendMessage(m message) os.Error {
-	body := m.Bytes()
-	h := header(msgHeader{int32(len(body) + _HEADER_SIZE), rand.Int31(), 0, m.OpCode()})
-
-	msg := append(h, body...)
-	_, err := self.conn.Write(msg)
-
-	return err
-}
-
-// To use with messages that receive a response from database
-// 'opQuery', 'opGetMore'.
-func (self *Connection) sendMessageToReply(m message, reqID int32) os.Error {
-	body := m.Bytes()
-	h := header(msgHeader{int32(len(body) + _HEADER_SIZE), reqID, 0, m.OpCode()})
-
-	msg := append(h, body...)
-	_, err := self.conn.Write(msg)
-
-	return err
-}
-
 // === OP_UPDATE
 
 var fUpsert, fUpdateAll, fUpsertAll int32 // flags
@@ -84,60 +62,260 @@ func (self *Collection) UpsertAll(selector, document BSON) os.Error {
 }
 
 func (self *Collection) update(msg *opUpdate) os.Error {
-	return self.db.Conn.sendMessage(msg)
+	_, err := self.write(msg)
+	return err
 }
 
 // === OP_INSERT
 
-func (self *Collection) Insert(doc BSON) os.Error {
-	msg := &opInsert{self.fullName(), doc}
-	return self.db.Conn.sendMessage(msg)
+/* Largest document the server takes. */
+const MaxDocumentSize = 16 * 1024 * 1024
+
+var fContinueOnError int32 // flags
+
+// Calculates values of flags
+func init() {
+	setBit32(&fContinueOnError, f_CONTINUE_ON_ERROR)
+}
+
+/* Inserts a document, giving it a new ObjectId if it has no _id. Returns the
+_id of the document. */
+func (self *Collection) Insert(doc BSON) (BSON, os.Error) {
+	doc, id := withId(doc)
+	if err := self.insert(doc); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func (self *Collection) insert(doc BSON) os.Error {
+	msg := &opInsert{_ZERO, self.fullName(), []BSON{doc}}
+	_, err := self.write(msg)
+	return err
+}
+
+/* A batch of documents that failed to insert. */
+type BatchError struct {
+	First, Count int // documents of the batch, by their index in the call
+	Err          os.Error
+}
+
+func (self *BatchError) String() string {
+	return fmt.Sprintf("documents %d to %d: %s", self.First, self.First+self.Count-1, self.Err)
+}
+
+/* The failures of InsertMany, batch by batch. */
+type InsertManyError struct {
+	Batches []*BatchError
+}
+
+func (self *InsertManyError) String() string {
+	msg := fmt.Sprintf("%d of the insert batches failed", len(self.Batches))
+	for _, b := range self.Batches {
+		msg += "; " + b.String()
+	}
+	return msg
+}
+
+/* Inserts documents, as many as possible in each message, giving those
+without an _id a new ObjectId. Returns the _ids of the documents, in order.
+The first batch that fails stops the insert; the server stops at the
+failing document itself. Failures are reported as an *InsertManyError. */
+func (self *Collection) InsertMany(docs ...interface{}) ([]BSON, os.Error) {
+	return self.insertMany(_ZERO, docs)
+}
+
+/* Inserts documents as InsertMany does, but goes on after the documents
+that fail, as with a duplicate _id. The failing batches are all reported. */
+func (self *Collection) InsertManyContinueOnError(docs ...interface{}) ([]BSON, os.Error) {
+	return self.insertMany(fContinueOnError, docs)
+}
+
+func (self *Collection) insertMany(flags int32, docs []interface{}) ([]BSON, os.Error) {
+	ids := make([]BSON, len(docs))
+	bdocs := make([]BSON, len(docs))
+	for i, d := range docs {
+		b, err := Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		if b.Kind() != ObjectKind {
+			return nil, os.NewError(fmt.Sprintf("document %d is not a document", i))
+		}
+		bdocs[i], ids[i] = withId(b)
+	}
+
+	maxSize := DefaultMaxMessageSize
+	if options := self.db.Conn.poolOptions(); options.MaxMessageSize > 0 {
+		maxSize = options.MaxMessageSize
+	}
+	empty := _HEADER_SIZE + len((&opInsert{flags, self.fullName(), nil}).Bytes())
+
+	ierr := new(InsertManyError)
+	for first := 0; first < len(bdocs); {
+		// Fill the message up to its maximum size. A document too large
+		// for the server is a batch of its own, that fails.
+		var batchErr os.Error
+		size, n := empty, 0
+		for first+n < len(bdocs) {
+			l := len(bdocs[first+n].Bytes())
+			if l > MaxDocumentSize {
+				if n == 0 {
+					batchErr = os.NewError(fmt.Sprintf("document of %d bytes is over the maximum of %d", l, MaxDocumentSize))
+					n = 1
+				}
+				break
+			}
+			if n > 0 && size+l > maxSize {
+				break
+			}
+			size += l
+			n++
+		}
+
+		if batchErr == nil {
+			_, batchErr = self.write(&opInsert{flags, self.fullName(), bdocs[first : first+n]})
+		}
+		if batchErr != nil {
+			ierr.Batches = append(ierr.Batches, &BatchError{first, n, batchErr})
+			if flags&fContinueOnError == 0 {
+				break
+			}
+		}
+		first += n
+	}
+
+	if len(ierr.Batches) > 0 {
+		return ids, ierr
+	}
+	return ids, nil
 }
 
 // === OP_QUERY
 
 func (self *Collection) Query(query BSON, skip, limit int32) (*Cursor, os.Error) {
-	conn := self.db.Conn
-	reqID := getRequestID()
-	msg := &opQuery{o_NONE, self.fullName(), skip, limit, query}
+	return self.QueryFields(query, nil, skip, limit)
+}
+
+/* Queries documents, returning only the fields selected by fields, or
+whole documents if it is nil. Fields are chosen with 1 or left out with 0,
+and arrays cut with the Slice and ElemMatch projections:
 
-	if err := conn.sendMessageToReply(msg, reqID); err != nil {
+	fields, _ := Marshal(Doc{{"title", 1}, {"comments", Slice(5)}})
+*/
+func (self *Collection) QueryFields(query, fields BSON, skip, limit int32) (*Cursor, os.Error) {
+	cursor, err := self.query(&opQuery{o_NONE, self.fullName(), skip, limit, query, fields})
+	if err != nil {
 		return nil, err
 	}
+	cursor.limit = abs32(limit)
+	return cursor, nil
+}
 
-	reply, err := conn.readReply()
+func (self *Collection) query(msg *opQuery) (*Cursor, os.Error) {
+	conn := self.db.Conn
+	pref := self.ReadPreference()
+	pool, err := conn.readPool(pref)
 	if err != nil {
 		return nil, err
 	}
-	if reply.responseTo != reqID {
-		return nil, os.NewError("wrong responseTo code")
+	if msg, err = conn.readQuery(msg, pref); err != nil {
+		return nil, err
+	}
+
+	var cursor *Cursor
+	if msg.opts&o_EXHAUST != 0 {
+		if cursor, err = self.exhaustQuery(pool, msg); err != nil {
+			return nil, err
+		}
+	} else {
+		reply, err := conn.requestOn(self.db.ctx, pool, msg)
+		if err != nil {
+			return nil, err
+		}
+		cursor = newCursor(self, reply)
+	}
+	// The getMores and the killCursors go to the same server.
+	cursor.pool = pool
+
+	conn.track(cursor)
+	return cursor, nil
+}
+
+/* Runs a query in exhaust mode. The server streams every batch on the
+socket, which stays with the cursor until the last one. */
+func (self *Collection) exhaustQuery(pool *Pool, msg *opQuery) (*Cursor, os.Error) {
+	sock, err := pool.checkout(self.db.ctx)
+	if err != nil {
+		self.db.Conn.checkFailure(self.db.ctx, pool, nil, err)
+		return nil, err
+	}
+
+	reply, err := sock.roundTrip(msg)
+	if err != nil {
+		self.db.Conn.checkFailure(self.db.ctx, pool, sock, err)
+		pool.checkin(sock)
+		return nil, err
 	}
 
-	return &Cursor{self, reply.cursorID, 0, reply.documents}, nil
+	cursor := newCursor(self, reply)
+	if cursor.id == 0 {
+		pool.checkin(sock)
+	} else {
+		cursor.sock = sock
+		cursor.requestID = reply.requestID
+	}
+	return cursor, nil
 }
 
 func (self *Collection) FindAll(query BSON) (*Cursor, os.Error) {
 	return self.Query(query, 0, 0)
 }
 
+func (self *Collection) FindAllFields(query, fields BSON) (*Cursor, os.Error) {
+	return self.QueryFields(query, fields, 0, 0)
+}
+
 func (self *Collection) FindOne(query BSON) (BSON, os.Error) {
-	cursor, err := self.Query(query, 0, 1)
+	return self.FindOneFields(query, nil)
+}
+
+func (self *Collection) FindOneFields(query, fields BSON) (BSON, os.Error) {
+	cursor, err := self.QueryFields(query, fields, 0, 1)
 	if err != nil {
 		return nil, err
 	}
-	return cursor.GetNext()
+
+	doc, err := cursor.GetNext()
+	if err == os.EOF {
+		return nil, ErrNotFound
+	}
+	return doc, err
+}
+
+/* Projects the first n elements of an array, or the last ones if n is
+negative. */
+func Slice(n int) Doc {
+	return Doc{{"$slice", n}}
+}
+
+/* Projects n elements of an array, after skipping skip of them. */
+func SliceRange(skip, n int) Doc {
+	return Doc{{"$slice", []int{skip, n}}}
+}
+
+/* Projects the first element of an array matching cond. */
+func ElemMatch(cond interface{}) Doc {
+	return Doc{{"$elemMatch", cond}}
 }
 
 func (self *Collection) Count(query BSON) (int64, os.Error) {
-	cmd := &_Object{
-		map[string]BSON{
-			"count": &_String{self.name, _Null{}},
-			"query": query,
-		},
-		_Null{},
+	cmd, err := Marshal(Doc{{"count", self.name}, {"query", query}})
+	if err != nil {
+		return -1, err
 	}
 
-	reply, err := self.db.Command(cmd)
+	reply, err := self.db.command(cmd, self.ReadPreference())
 	if err != nil {
 		return -1, err
 	}
@@ -163,7 +341,8 @@ func (self *Collection) RemoveFirst(selector BSON) os.Error {
 }
 
 func (self *Collection) remove(msg *opDelete) os.Error {
-	return self.db.Conn.sendMessage(msg)
+	_, err := self.write(msg)
+	return err
 }
 
 
@@ -173,10 +352,15 @@ func (self *Collection) remove(msg *opDelete) os.Error {
 type indexDesc struct {
 	Name string
 	Ns   string
-	Key  map[string]int
+	Key  interface{}
 }
 
-func (self *Collection) EnsureIndex(name string, index map[string]int) os.Error {
+/* Creates an index. The keys are given as a map or, for compound indexes
+where the order of the keys matters, as a Doc:
+
+	coll.EnsureIndex("name_age", Doc{{"name", 1}, {"age", -1}})
+*/
+func (self *Collection) EnsureIndex(name string, index interface{}) os.Error {
 	coll := self.db.GetCollection("system.indexes")
 	id := &indexDesc{name, self.fullName(), index}
 
@@ -185,7 +369,8 @@ func (self *Collection) EnsureIndex(name string, index map[string]int) os.Error
 		return err
 	}
 
-	return coll.Insert(desc)
+	// Index descriptions have no _id.
+	return coll.insert(desc)
 }
 
 /* Deletes all indexes on the specified collection. */
@@ -195,12 +380,10 @@ func (self *Collection) DropIndexes() os.Error {
 
 /* Deletes a single index. */
 func (self *Collection) DropIndex(name string) os.Error {
-	cmdm := map[string]string{
-		"deleteIndexes": self.fullName(),
-		"index":         name,
-	}
-
-	cmd, err := Marshal(cmdm)
+	cmd, err := Marshal(Doc{
+		{"deleteIndexes", self.fullName()},
+		{"index", name},
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,206 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"os"
+)
+
+
+/* How the server acknowledges writes. An acknowledged write is followed by
+a getLastError command on the same socket, and its outcome is reported to
+the caller.
+
+http://www.mongodb.org/display/DOCS/getLastError+Command
+*/
+type WriteConcern struct {
+	W        int    // servers that must acknowledge the write; 0 waits for none
+	WMode    string // such as "majority"; overrides W if set
+	WTimeout int64  // milliseconds to wait for the W servers; zero waits forever
+	J        bool   // wait for the write to be in the journal
+	FSync    bool   // wait for the write to be flushed to disk
+}
+
+var (
+	Acknowledged   = &WriteConcern{W: 1}
+	Unacknowledged = &WriteConcern{W: 0}
+)
+
+func (self *WriteConcern) acknowledged() bool {
+	return self.W > 0 || self.WMode != "" || self.J || self.FSync
+}
+
+/* Gets the getLastError command asking for this write concern. */
+func (self *WriteConcern) command() BSON {
+	cmd := Doc{{"getlasterror", 1}}
+
+	switch {
+	case self.WMode != "":
+		cmd = append(cmd, DocElem{"w", self.WMode})
+	case self.W > 1:
+		cmd = append(cmd, DocElem{"w", self.W})
+	}
+	if self.WTimeout > 0 {
+		cmd = append(cmd, DocElem{"wtimeout", self.WTimeout})
+	}
+	if self.J {
+		cmd = append(cmd, DocElem{"j", true})
+	}
+	if self.FSync {
+		cmd = append(cmd, DocElem{"fsync", true})
+	}
+
+	b, _ := Marshal(cmd)
+	return b
+}
+
+/* A write reported as failed by getLastError. */
+type WriteError struct {
+	Code            int
+	Message         string
+	N               int  // documents affected
+	UpdatedExisting bool // an update modified an existing document
+}
+
+func (self *WriteError) String() string {
+	if self.Code != 0 {
+		return fmt.Sprintf("write failed: %s (code %d)", self.Message, self.Code)
+	}
+	return "write failed: " + self.Message
+}
+
+/* Gets the error reported by a getLastError reply, if any. */
+func lastError(doc BSON) os.Error {
+	if doc.Get("ok").Kind() != NullKind && toInt(doc.Get("ok")) == 0 {
+		return &WriteError{Code: toInt(doc.Get("code")), Message: doc.Get("errmsg").String()}
+	}
+
+	werr := &WriteError{
+		Code:            toInt(doc.Get("code")),
+		N:               toInt(doc.Get("n")),
+		UpdatedExisting: doc.Get("updatedExisting").Bool(),
+	}
+	switch {
+	case doc.Get("err").Kind() == StringKind:
+		werr.Message = doc.Get("err").String()
+	case doc.Get("wtimeout").Bool():
+		werr.Message = "timed out waiting for replication"
+	case doc.Get("jnote").Kind() == StringKind:
+		werr.Message = doc.Get("jnote").String()
+	case doc.Get("wnote").Kind() == StringKind:
+		werr.Message = doc.Get("wnote").String()
+	default:
+		return nil
+	}
+	return werr
+}
+
+/* Gets the value of a numeric element, whatever its BSON type. */
+func toInt(b BSON) int {
+	switch b.Kind() {
+	case NumberKind:
+		return int(b.Number())
+	case IntKind:
+		return int(b.Int())
+	case LongKind:
+		return int(b.Long())
+	case BooleanKind:
+		if b.Bool() {
+			return 1
+		}
+	}
+	return 0
+}
+
+
+// === Setting the write concern
+// ===
+
+/* Sets the write concern of the collections got from this connection that
+don't set their own. nil restores the default, Acknowledged. */
+func (self *Connection) SetWriteConcern(wc *WriteConcern) {
+	self.writeConcern = wc
+}
+
+func (self *Connection) WriteConcern() *WriteConcern {
+	if self.writeConcern == nil {
+		return Acknowledged
+	}
+	return self.writeConcern
+}
+
+/* Sets the write concern of the collections got from this database. nil
+falls back to the connection's. */
+func (self *Database) SetWriteConcern(wc *WriteConcern) {
+	self.writeConcern = wc
+}
+
+func (self *Database) WriteConcern() *WriteConcern {
+	if self.writeConcern == nil {
+		return self.Conn.WriteConcern()
+	}
+	return self.writeConcern
+}
+
+/* Sets the write concern of this collection. nil falls back to the
+database's. */
+func (self *Collection) SetWriteConcern(wc *WriteConcern) {
+	self.writeConcern = wc
+}
+
+func (self *Collection) WriteConcern() *WriteConcern {
+	if self.writeConcern == nil {
+		return self.db.WriteConcern()
+	}
+	return self.writeConcern
+}
+
+
+// === Writing
+// ===
+
+/* Sends a write message. When the write concern asks for it, the outcome
+is checked with getLastError on the same socket and its reply returned. */
+func (self *Collection) write(m message) (BSON, os.Error) {
+	conn := self.db.Conn
+	wc := self.WriteConcern()
+	if !wc.acknowledged() {
+		return nil, conn.sendMessage(self.db.ctx, m)
+	}
+
+	pool, err := conn.primary()
+	if err != nil {
+		return nil, err
+	}
+	sock, err := pool.checkout(self.db.ctx)
+	if err != nil {
+		conn.checkFailure(self.db.ctx, pool, nil, err)
+		return nil, err
+	}
+	defer pool.checkin(sock)
+
+	doc, err := self.writeOn(sock, m, wc)
+	conn.checkFailure(self.db.ctx, pool, sock, err)
+	return doc, err
+}
+
+func (self *Collection) writeOn(sock *socket, m message, wc *WriteConcern) (BSON, os.Error) {
+	if err := sock.send(m); err != nil {
+		return nil, err
+	}
+
+	gle := &opQuery{o_NONE, self.db.name + ".$cmd", 0, -1, wc.command(), nil}
+	reply, err := sock.roundTrip(gle)
+	if err != nil {
+		return nil, err
+	}
+	if reply.documents.Len() == 0 {
+		return nil, os.NewError("no reply to getLastError")
+	}
+
+	doc := reply.documents.At(0).(BSON)
+	return doc, lastError(doc)
+}
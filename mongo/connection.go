@@ -7,7 +7,6 @@ package mongo
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
 )
@@ -17,9 +16,19 @@ import (
 const _PORT = 27017
 
 
+/* A connection to a MongoDB server, or to a replica set. Sockets are drawn
+from a Pool, so a Connection and the databases, collections and cursors got
+from it can be used from many goroutines at once. */
 type Connection struct {
-	Addr *net.TCPAddr
-	conn *net.TCPConn
+	Addr    *net.TCPAddr // of the server, or of the primary when connected
+	pool    *Pool        // nil for a replica set
+	replset *ReplicaSet
+
+	options        *ConnectOptions // nil unless created with ConnectWithOptions
+	writeConcern   *WriteConcern
+	readPreference *ReadPreference
+
+	cursors *cursorRegistry
 }
 
 func Connect(host string) (*Connection, os.Error) {
@@ -37,45 +46,246 @@ func ConnectAt(host string, port int) (*Connection, os.Error) {
 }
 
 func ConnectByAddr(addr *net.TCPAddr) (*Connection, os.Error) {
-	// Connects from local host (nil)
-	conn, err := net.DialTCP("tcp", nil, addr)
+	return ConnectByAddrPool(addr, DefaultPoolOptions)
+}
+
+/* Creates a new connection whose sockets are pooled following options. */
+func ConnectByAddrPool(addr *net.TCPAddr, options PoolOptions) (*Connection, os.Error) {
+	return connectByAddr(addr, options, &dialer{})
+}
+
+func connectByAddr(addr *net.TCPAddr, options PoolOptions, d *dialer) (*Connection, os.Error) {
+	pool, err := newPool(addr, options, d)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Connection{addr, conn}, nil
+	return &Connection{Addr: addr, pool: pool, cursors: newCursorRegistry()}, nil
 }
 
-/* Reconnects using the same address `Addr`. */
+/* Reconnects using the same address `Addr` and settings. A replica set is
+discovered again, from the seeds and the members known. */
 func (self *Connection) Reconnect() (*Connection, os.Error) {
-	connection, err := ConnectByAddr(self.Addr)
+	var connection *Connection
+	var credentials []*credential
+	var err os.Error
+	if rs := self.replset; rs != nil {
+		seeds := append([]string{}, rs.seeds...)
+		for _, m := range rs.Members() {
+			seeds = append(seeds, m.Addr)
+		}
+		connection, err = connectReplicaSet(rs.Name, seeds, rs.options, rs.interval, rs.newDialer)
+
+		rs.mutex.Lock()
+		credentials = rs.credentials
+		rs.mutex.Unlock()
+	} else {
+		connection, err = connectByAddr(self.Addr, self.pool.options, self.pool.dialer)
+
+		self.pool.mutex.Lock()
+		credentials = self.pool.credentials
+		self.pool.mutex.Unlock()
+	}
 	if err != nil {
 		return nil, err
 	}
+	connection.options = self.options
+	connection.writeConcern = self.writeConcern
+	connection.readPreference = self.readPreference
+	for _, cred := range credentials {
+		connection.addCredential(cred)
+	}
+
+	if self.cursors != nil {
+		self.cursors.mutex.Lock()
+		connection.cursors.finalize = self.cursors.finalize
+		self.cursors.mutex.Unlock()
+	}
 
 	return connection, nil
 }
 
-/* Disconnects the conection from MongoDB. */
+/* Disconnects the conection from MongoDB, killing the cursors left open
+and closing every pooled socket. */
 func (self *Connection) Disconnect() os.Error {
-	if err := self.conn.Close(); err != nil {
-		return err
+	for pool, ids := range self.untrackAll() {
+		// At worst, the server times the cursors out.
+		self.sendMessageOn(nil, pool, &opKillCursors{int32(len(ids)), ids})
+	}
+
+	if self.replset != nil {
+		self.replset.close()
+	} else {
+		self.pool.Close()
 	}
 	return nil
 }
 
 func (self *Connection) GetDB(name string) *Database {
-	return &Database{self, name}
+	return &Database{Conn: self, name: name}
+}
+
+/* Gets the database named in the connection string, or "test". */
+func (self *Connection) GetDefaultDB() *Database {
+	if self.options == nil || self.options.Database == "" {
+		return self.GetDB("test")
+	}
+	return self.GetDB(self.options.Database)
+}
+
+/* Gets the settings given to ConnectWithOptions, or nil. */
+func (self *Connection) Options() *ConnectOptions {
+	return self.options
+}
+
+/* Gets the pool of the server, or of the primary of a replica set; nil if
+there is no primary. */
+func (self *Connection) Pool() *Pool {
+	pool, _ := self.primary()
+	return pool
+}
+
+/* Gets the pool of the server, or of the primary of a replica set. */
+func (self *Connection) primary() (*Pool, os.Error) {
+	if self.replset != nil {
+		return self.replset.primaryPool()
+	}
+	return self.pool, nil
+}
+
+/* Gets the options of the pools of the connection. */
+func (self *Connection) poolOptions() PoolOptions {
+	if self.replset != nil {
+		return self.replset.options
+	}
+	return self.pool.options
+}
+
+/* Keeps cred for the sockets of the connection to log in with. */
+func (self *Connection) addCredential(cred *credential) {
+	if self.replset != nil {
+		self.replset.addCredential(cred)
+	} else {
+		self.pool.addCredential(cred)
+	}
+}
+
+/* Has a replica set discovered again if err shows that the server of pool
+failed, or is no longer the primary. sock is where err happened, if any. An
+operation aborted by its context, ctx, says nothing about the server. */
+func (self *Connection) checkFailure(ctx Context, pool *Pool, sock *socket, err os.Error) {
+	if err == nil || self.replset == nil {
+		return
+	}
+	if _, ok := err.(*AuthError); ok {
+		return
+	}
+	if err == ErrCanceled || err == ErrDeadlineExceeded || (ctx != nil && err == ctx.Err()) {
+		return
+	}
+	if sock == nil || sock.dead || isNotMaster(err) {
+		self.replset.failed(pool)
+	}
+}
+
+// === Client Request Messages
+// ===
+
+/* Sends a message that gets no reply on any free socket of the primary,
+unless ctx is done first. */
+func (self *Connection) sendMessage(ctx Context, m message) os.Error {
+	pool, err := self.primary()
+	if err != nil {
+		return err
+	}
+	return self.sendMessageOn(ctx, pool, m)
+}
+
+/* Sends a message that gets no reply on any free socket of pool. */
+func (self *Connection) sendMessageOn(ctx Context, pool *Pool, m message) os.Error {
+	if pool == nil {
+		return ErrNoPrimary
+	}
+	sock, err := pool.checkout(ctx)
+	if err != nil {
+		self.checkFailure(ctx, pool, nil, err)
+		return err
+	}
+	defer pool.checkin(sock)
+
+	err = sock.send(m)
+	self.checkFailure(ctx, pool, sock, err)
+	return err
+}
+
+/* Sends a message to the primary and waits for its reply, for 'opQuery'
+and 'opGetMore', unless ctx is done first. */
+func (self *Connection) request(ctx Context, m message) (*opReply, os.Error) {
+	pool, err := self.primary()
+	if err != nil {
+		return nil, err
+	}
+	return self.requestOn(ctx, pool, m)
+}
+
+/* Sends a message to the server of pool and waits for its reply. */
+func (self *Connection) requestOn(ctx Context, pool *Pool, m message) (*opReply, os.Error) {
+	if pool == nil {
+		return nil, ErrNoPrimary
+	}
+	sock, err := pool.checkout(ctx)
+	if err != nil {
+		self.checkFailure(ctx, pool, nil, err)
+		return nil, err
+	}
+	defer pool.checkin(sock)
+
+	reply, err := sock.roundTrip(m)
+	self.checkFailure(ctx, pool, sock, err)
+	return reply, err
 }
 
 // === OP_REPLY
 
-/* Gets the message of reply from database. */
-func (self *Connection) readReply() (*opReply, os.Error) {
-	size_bits, _ := ioutil.ReadAll(io.LimitReader(self.conn, 4))
-	size := pack.Uint32(size_bits)
-	rest, _ := ioutil.ReadAll(io.LimitReader(self.conn, int64(size)-4))
-	reply := parseReply(rest)
+/* Gets the message of reply from database. A socket that gives a bad reply
+is left dead, since there is no telling where the next message starts. */
+func (self *socket) readReply() (*opReply, os.Error) {
+	reply, err := self.readFrame()
+	if err != nil {
+		return nil, self.ioError(err)
+	}
 
 	return reply, nil
 }
+
+func (self *socket) readFrame() (*opReply, os.Error) {
+	size_bits := make([]byte, _WORD32)
+	if _, err := io.ReadFull(self.conn, size_bits); err != nil {
+		return nil, err
+	}
+
+	size := int32(pack.Uint32(size_bits))
+	if size < _REPLY_SIZE {
+		return nil, os.NewError(fmt.Sprintf("reply of %d bytes is too short", size))
+	}
+	if max := self.maxMessageSize(); size > max {
+		return nil, os.NewError(fmt.Sprintf("reply of %d bytes is bigger than the maximum of %d", size, max))
+	}
+
+	rest := make([]byte, size-4)
+	if _, err := io.ReadFull(self.conn, rest); err != nil {
+		if err == os.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return parseReply(rest)
+}
+
+func (self *socket) maxMessageSize() int32 {
+	if self.pool == nil || self.pool.options.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return int32(self.pool.options.MaxMessageSize)
+}
@@ -0,0 +1,157 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* Contexts
+
+An operation run with a context is aborted as soon as the context is done:
+a wait for a free socket gives up, and the socket of a read or write in
+flight is closed, so that the server sees the client hang up. The socket is
+never reused, since there is no telling what is left on the wire.
+*/
+
+package mongo
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+
+var (
+	ErrCanceled         = os.NewError("operation canceled")
+	ErrDeadlineExceeded = os.NewError("operation deadline exceeded")
+)
+
+/* Tells when operations must stop, such as when the request they serve is
+over. Done gets closed then, and Err tells why; it is nil until then. Any
+type with these methods can be used, as well as those of WithCancel and
+WithTimeout. */
+type Context interface {
+	Done() <-chan bool
+	Err() os.Error
+}
+
+type cancelContext struct {
+	done  chan bool
+	mutex sync.Mutex
+	err   os.Error
+}
+
+func (self *cancelContext) Done() <-chan bool {
+	return self.done
+}
+
+func (self *cancelContext) Err() os.Error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.err
+}
+
+func (self *cancelContext) cancel(err os.Error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.err != nil {
+		return
+	}
+	self.err = err
+	close(self.done)
+}
+
+/* Gets a context that is done when cancel is called, or when parent is
+done if it is not nil. cancel should be called once the operations are
+over, to release the context. */
+func WithCancel(parent Context) (ctx Context, cancel func()) {
+	self := &cancelContext{done: make(chan bool)}
+	if parent != nil {
+		go func() {
+			select {
+			case <-parent.Done():
+				self.cancel(parent.Err())
+			case <-self.done:
+			}
+		}()
+	}
+	return self, func() { self.cancel(ErrCanceled) }
+}
+
+/* Gets a context that is done after timeout nanoseconds, with
+ErrDeadlineExceeded, or sooner as WithCancel. */
+func WithTimeout(parent Context, timeout int64) (ctx Context, cancel func()) {
+	c, cancelParent := WithCancel(parent)
+	timer := time.AfterFunc(timeout, func() { c.(*cancelContext).cancel(ErrDeadlineExceeded) })
+	return c, func() {
+		timer.Stop()
+		cancelParent()
+	}
+}
+
+/* Gets the Done channel of ctx, or nil, which is never ready, if ctx is
+nil. */
+func doneOf(ctx Context) <-chan bool {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Done()
+}
+
+
+// === Operations with a context
+// ===
+
+/* Gets a copy of the database whose operations, and the cursors they
+open, are aborted when ctx is done. */
+func (self *Database) WithContext(ctx Context) *Database {
+	db := *self
+	db.ctx = ctx
+	return &db
+}
+
+/* Gets a copy of the collection whose operations, and the cursors and
+bulks they open, are aborted when ctx is done. */
+func (self *Collection) WithContext(ctx Context) *Collection {
+	coll := *self
+	coll.db = self.db.WithContext(ctx)
+	return &coll
+}
+
+func (self *Database) CommandContext(ctx Context, cmd BSON) (BSON, os.Error) {
+	return self.WithContext(ctx).Command(cmd)
+}
+
+/* Queries as Query does, with a cursor whose getMores are aborted as well
+when ctx is done. */
+func (self *Collection) QueryContext(ctx Context, query BSON, skip, limit int32) (*Cursor, os.Error) {
+	return self.WithContext(ctx).Query(query, skip, limit)
+}
+
+func (self *Collection) FindOneContext(ctx Context, query BSON) (BSON, os.Error) {
+	return self.WithContext(ctx).FindOne(query)
+}
+
+func (self *Collection) CountContext(ctx Context, query BSON) (int64, os.Error) {
+	return self.WithContext(ctx).Count(query)
+}
+
+func (self *Collection) InsertContext(ctx Context, doc BSON) (BSON, os.Error) {
+	return self.WithContext(ctx).Insert(doc)
+}
+
+func (self *Collection) InsertManyContext(ctx Context, docs ...interface{}) ([]BSON, os.Error) {
+	return self.WithContext(ctx).InsertMany(docs...)
+}
+
+func (self *Collection) UpdateContext(ctx Context, selector, document BSON) os.Error {
+	return self.WithContext(ctx).Update(selector, document)
+}
+
+func (self *Collection) UpsertContext(ctx Context, selector, document BSON) os.Error {
+	return self.WithContext(ctx).Upsert(selector, document)
+}
+
+func (self *Collection) RemoveContext(ctx Context, selector BSON) os.Error {
+	return self.WithContext(ctx).Remove(selector)
+}
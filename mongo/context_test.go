@@ -0,0 +1,119 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+/* Starts a server that reads the messages sent to it and never replies. */
+func stallingServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, _, _, err := readMessage(conn); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func stallingConnection(t *testing.T, l net.Listener, options PoolOptions) *Connection {
+	conn, err := ConnectByAddrPool(l.Addr().(*net.TCPAddr), options)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	return conn
+}
+
+func TestReadTimeout(t *testing.T) {
+	l := stallingServer(t)
+	defer l.Close()
+
+	options := DefaultPoolOptions
+	options.ReadTimeout = 50e6
+	conn := stallingConnection(t, l, options)
+	defer conn.Disconnect()
+
+	all, _ := Marshal(Doc{})
+	start := time.Nanoseconds()
+	_, err := conn.GetDB("db").GetCollection("c").FindOne(all)
+	assertTrue(err != nil, "query on a stalled server", t)
+	assertTrue(time.Nanoseconds()-start < 5e9, "read didn't time out", t)
+	assertTrue(conn.Pool().Stats().Open == 0, "socket kept after a timeout", t)
+}
+
+func TestContext(t *testing.T) {
+	l := stallingServer(t)
+	defer l.Close()
+
+	conn := stallingConnection(t, l, DefaultPoolOptions)
+	defer conn.Disconnect()
+	coll := conn.GetDB("db").GetCollection("c")
+	doc, _ := Marshal(Doc{{"a", 1}})
+	all, _ := Marshal(Doc{})
+
+	ctx, cancel := WithCancel(nil)
+	go func() {
+		time.Sleep(50e6)
+		cancel()
+	}()
+	_, err := coll.FindOneContext(ctx, all)
+	assertTrue(err == ErrCanceled, fmt.Sprintf("query with a canceled context: %v", err), t)
+	assertTrue(conn.Pool().Stats().Open == 0, "socket kept after a cancel", t)
+
+	ctx, cancel = WithTimeout(nil, 50e6)
+	defer cancel()
+	_, err = conn.GetDB("db").CommandContext(ctx, doc)
+	assertTrue(err == ErrDeadlineExceeded, fmt.Sprintf("command past its deadline: %v", err), t)
+
+	// A child is done with its parent; a done context doesn't even send.
+	child, cancelChild := WithCancel(ctx)
+	defer cancelChild()
+	<-child.Done()
+	assertTrue(child.Err() == ErrDeadlineExceeded, "child of an expired context", t)
+	_, err = coll.InsertContext(child, doc)
+	assertTrue(err == ErrDeadlineExceeded, fmt.Sprintf("insert with an expired context: %v", err), t)
+
+	// Waiting for a free socket gives up too.
+	options := DefaultPoolOptions
+	options.MaxSockets = 1
+	conn2 := stallingConnection(t, l, options)
+	defer conn2.Disconnect()
+	pool := conn2.Pool()
+	sock, err := pool.checkout(nil)
+	if err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+	ctx, cancel = WithTimeout(nil, 50e6)
+	defer cancel()
+	_, err = conn2.GetDB("db").GetCollection("c").CountContext(ctx, all)
+	assertTrue(err == ErrDeadlineExceeded, fmt.Sprintf("wait for a socket past the deadline: %v", err), t)
+	pool.checkin(sock)
+
+	// A context done after the operation leaves the socket alone.
+	ctx, cancel = WithCancel(nil)
+	sock, _ = pool.checkout(ctx)
+	pool.checkin(sock)
+	cancel()
+	assertTrue(!sock.dead && pool.Stats().Idle == 1, "socket killed after its operation", t)
+}
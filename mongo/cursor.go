@@ -6,33 +6,205 @@ package mongo
 
 import (
 	"container/vector"
+	"fmt"
 	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
 )
 
 
+var ErrCursorNotFound = os.NewError("cursor not found on server")
+
+/* A query failure, as reported by the $err field of the reply. */
+type QueryError struct {
+	Code    int
+	Message string
+}
+
+func (self *QueryError) String() string {
+	if self.Code != 0 {
+		return fmt.Sprintf("query failed: %s (code %d)", self.Message, self.Code)
+	}
+	return "query failed: " + self.Message
+}
+
 type Cursor struct {
 	collection *Collection
 	id         int64
 	pos        int
 	docs       *vector.Vector
+
+	limit     int32    // documents to return at most; zero for no limit
+	returned  int32
+	batchSize int32    // documents to ask for in each getMore; zero for the server's default
+	err       os.Error // failure that stopped the iteration
+
+	// Pool of the server the cursor is open on.
+	pool *Pool
+
+	// Socket of an exhaust cursor, on which the server sends the batches
+	// in response to the last one, requestID.
+	sock      *socket
+	requestID int32
+
+	// Set when the server supports the AwaitData query option.
+	AwaitCapable bool
+	// Set by mongos when the shard configuration of the last batch was stale.
+	ShardConfigStale bool
+
+	mutex sync.Mutex
+}
+
+func newCursor(collection *Collection, reply *opReply) *Cursor {
+	cursor := &Cursor{collection: collection, id: reply.cursorID, docs: reply.documents}
+	cursor.AwaitCapable = reply.responseFlag&r_AWAIT_CAPABLE != 0
+	cursor.ShardConfigStale = reply.responseFlag&r_SHARD_CONFIG_STALE != 0
+	return cursor
+}
+
+/* Gets a cursor that reports err. */
+func errCursor(collection *Collection, err os.Error) *Cursor {
+	return &Cursor{collection: collection, docs: new(vector.Vector), err: err}
 }
 
+/* Gets the next document. Returns os.EOF after the last one, or the failure
+that stopped the iteration. */
 func (self *Cursor) GetNext() (BSON, os.Error) {
-	if self.HasMore() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.hasMore() {
 		doc := self.docs.At(self.pos).(BSON)
 		self.pos = self.pos + 1
+		self.returned++
 		return doc, nil
 	}
-	return nil, os.NewError("cursor failure")
+	if self.err != nil {
+		return nil, self.err
+	}
+	return nil, os.EOF
+}
+
+/* Decodes the next document into result, a *BSON or anything Unmarshal
+takes. Returns false after the last document or on failure, which Err
+then reports:
+
+	var p Person
+	for cursor.Next(&p) {
+		...
+	}
+	if err := cursor.Err(); err != nil {
+		...
+	}
+*/
+func (self *Cursor) Next(result interface{}) bool {
+	doc, err := self.GetNext()
+	if err != nil {
+		return false
+	}
+
+	if err = decode(doc, result); err != nil {
+		self.mutex.Lock()
+		self.err = err
+		self.mutex.Unlock()
+		return false
+	}
+	return true
+}
+
+/* Gets the failure that stopped the iteration, or nil if the cursor ran
+out of documents or is not done. */
+func (self *Cursor) Err() os.Error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.err
+}
+
+/* Decodes all the remaining documents into result, a pointer to a slice of
+BSON or of anything Unmarshal takes, and closes the cursor. */
+func (self *Cursor) All(result interface{}) os.Error {
+	defer self.Close()
+
+	if docs, ok := result.(*[]BSON); ok {
+		*docs = (*docs)[0:0]
+		var doc BSON
+		for self.Next(&doc) {
+			*docs = append(*docs, doc)
+		}
+		return self.Err()
+	}
+
+	pv, ok := reflect.NewValue(result).(*reflect.PtrValue)
+	if !ok {
+		return os.NewError("result must be a pointer to a slice")
+	}
+	v, ok := pv.Elem().(*reflect.SliceValue)
+	if !ok {
+		return os.NewError("result must be a pointer to a slice")
+	}
+
+	st := v.Type().(*reflect.SliceType)
+	v.Set(reflect.MakeSlice(st, 0, 0))
+	for i := 0; ; i++ {
+		if i == v.Cap() {
+			nv := reflect.MakeSlice(st, i, 2*i+1)
+			reflect.Copy(nv, v)
+			v.Set(nv)
+		}
+		v.SetLen(i + 1)
+		if !self.Next(v.Elem(i).Addr().Interface()) {
+			v.SetLen(i)
+			break
+		}
+	}
+	return self.Err()
+}
+
+/* Sets how many documents each getMore asks for. Zero leaves it to the
+server. */
+func (self *Cursor) SetBatchSize(n int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.batchSize = int32(n)
+}
+
+/* Reports whether the cursor is still open on the server. A tailable cursor
+stays open after the last document, waiting for new ones. */
+func (self *Cursor) Alive() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.id != 0
 }
 
 func (self *Cursor) HasMore() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.hasMore()
+}
+
+func (self *Cursor) hasMore() bool {
+	if self.err != nil {
+		return false
+	}
+	if self.limit > 0 && self.returned >= self.limit {
+		self.close()
+		return false
+	}
 	if self.pos < self.docs.Len() {
 		return true
 	}
+	if self.id == 0 {
+		return false
+	}
 
-	err := self.GetMore()
-	if err != nil {
+	if err := self.getMore(); err != nil {
+		self.err = err
 		return false
 	}
 
@@ -46,28 +218,50 @@ func (self *Cursor) HasMore() bool {
 // === OP_GET_MORE
 
 func (self *Cursor) GetMore() os.Error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.getMore()
+}
+
+func (self *Cursor) getMore() os.Error {
 	if self.id == 0 {
 		return os.NewError("no cursorID")
 	}
 
-	conn := self.collection.db.Conn
-	reqID := getRequestID()
-	msg := &opGetMore{self.collection.fullName(), 0, self.id}
-
-	if err := conn.sendMessageToReply(msg, reqID); err != nil {
-		return err
+	var reply *opReply
+	var err os.Error
+	if self.sock != nil {
+		reply, err = self.sock.readMore(self.requestID)
+		if err != nil || reply.cursorID == 0 {
+			self.releaseSocket()
+		} else {
+			self.requestID = reply.requestID
+		}
+	} else {
+		n := self.batchSize
+		if self.limit > 0 {
+			n = numberToReturn(self.limit-self.returned, self.batchSize)
+		}
+		msg := &opGetMore{self.collection.fullName(), n, self.id}
+		reply, err = self.collection.db.Conn.requestOn(self.collection.db.ctx, self.server(), msg)
+	}
+	if err == ErrCursorNotFound {
+		// The server forgot about the cursor; don't try it again.
+		self.forget()
+		self.id = 0
 	}
-
-	reply, err := conn.readReply()
 	if err != nil {
 		return err
 	}
-	if reply.responseTo != reqID {
-		return os.NewError("wrong responseTo code")
-	}
 
+	if reply.cursorID == 0 {
+		self.forget()
+	}
+	self.id = reply.cursorID
 	self.pos = 0
 	self.docs = reply.documents
+	self.ShardConfigStale = reply.responseFlag&r_SHARD_CONFIG_STALE != 0
 
 	return nil
 }
@@ -75,11 +269,182 @@ func (self *Cursor) GetMore() os.Error {
 // === OP_KILL_CURSORS
 
 func (self *Cursor) Close() os.Error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.close()
+}
+
+func (self *Cursor) close() os.Error {
 	if self.id == 0 {
 		// not open on server
 		return nil
 	}
 
+	if self.sock != nil {
+		// The server is still streaming batches; hanging up is the only
+		// way to stop it, and kills the cursor.
+		self.sock.dead = true
+		self.releaseSocket()
+		self.forget()
+		self.id = 0
+		return nil
+	}
+
+	if !self.forget() {
+		// Already killed, by Connection.Disconnect.
+		self.id = 0
+		return nil
+	}
+
+	// Sent even once the context of the cursor is done.
 	msg := &opKillCursors{1, []int64{self.id}}
-	return self.collection.db.Conn.sendMessage(msg)
+	self.id = 0
+	return self.collection.db.Conn.sendMessageOn(nil, self.server(), msg)
+}
+
+/* Gets the pool of the server the cursor is open on. */
+func (self *Cursor) server() *Pool {
+	if self.pool == nil {
+		return self.collection.db.Conn.Pool()
+	}
+	return self.pool
+}
+
+func (self *Cursor) releaseSocket() {
+	self.sock.pool.checkin(self.sock)
+	self.sock = nil
+}
+
+
+// === Open cursors
+// ===
+
+/* The cursors of a connection that are open on the server. Only their ids
+are kept, so that a cursor dropped without Close can still be garbage
+collected. */
+type cursorRegistry struct {
+	mutex    sync.Mutex
+	open     map[int64]*openCursor
+	finalize bool
+}
+
+type openCursor struct {
+	pool       *Pool
+	collection string
+	created    int64
+	pcs        []uintptr // where the cursor was created
+}
+
+func newCursorRegistry() *cursorRegistry {
+	return &cursorRegistry{open: make(map[int64]*openCursor)}
+}
+
+/* An open cursor, as listed by Connection.OpenCursors. */
+type CursorInfo struct {
+	Id         int64
+	Collection string // full name, "db.collection"
+	Created    int64  // nanoseconds since the epoch
+	Stack      string // calls that created the cursor, innermost first
+}
+
+/* Lists the cursors open on the server, to find the ones never closed. */
+func (self *Connection) OpenCursors() []CursorInfo {
+	r := self.cursors
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	infos := make([]CursorInfo, 0, len(r.open))
+	for id, c := range r.open {
+		infos = append(infos, CursorInfo{id, c.collection, c.created, formatStack(c.pcs)})
+	}
+	return infos
+}
+
+/* Sets whether cursors get a finalizer that closes them once they are
+garbage collected. This is a safety net for cursors that are never
+closed; they would otherwise stay open on the server until it times them
+out, after 10 minutes. */
+func (self *Connection) SetCursorFinalizer(on bool) {
+	if self.cursors == nil {
+		return
+	}
+	self.cursors.mutex.Lock()
+	self.cursors.finalize = on
+	self.cursors.mutex.Unlock()
+}
+
+/* Registers a new cursor if it is open on the server. */
+func (self *Connection) track(cursor *Cursor) {
+	r := self.cursors
+	if r == nil || cursor.id == 0 {
+		return
+	}
+
+	pcs := make([]uintptr, 32)
+	pcs = pcs[0:runtime.Callers(3, pcs)]
+
+	r.mutex.Lock()
+	r.open[cursor.id] = &openCursor{cursor.server(), cursor.collection.fullName(), time.Nanoseconds(), pcs}
+	finalize := r.finalize
+	r.mutex.Unlock()
+
+	if finalize {
+		runtime.SetFinalizer(cursor, func(c *Cursor) { c.Close() })
+	}
+}
+
+/* Unregisters a cursor, reporting whether it was registered. */
+func (self *Connection) untrack(id int64) bool {
+	r := self.cursors
+	if r == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.open[id]
+	r.open[id] = nil, false
+	return ok
+}
+
+/* Unregisters all the cursors, returning their ids by server. */
+func (self *Connection) untrackAll() map[*Pool][]int64 {
+	r := self.cursors
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ids := make(map[*Pool][]int64)
+	for id, c := range r.open {
+		ids[c.pool] = append(ids[c.pool], id)
+	}
+	r.open = make(map[int64]*openCursor)
+	return ids
+}
+
+/* Unregisters the cursor as it is closed on the server. */
+func (self *Cursor) forget() bool {
+	if self.collection == nil {
+		return false
+	}
+	return self.collection.db.Conn.untrack(self.id)
+}
+
+func formatStack(pcs []uintptr) string {
+	s := ""
+	for _, pc := range pcs {
+		f := runtime.FuncForPC(pc)
+		if f == nil {
+			continue
+		}
+		file, line := f.FileLine(pc)
+		s += fmt.Sprintf("%s\n\t%s:%d\n", f.Name(), file, line)
+	}
+	return s
 }
@@ -6,6 +6,7 @@ package mongo
 
 import (
 	"container/vector"
+	"fmt"
 	"os"
 )
 
@@ -13,10 +14,14 @@ import (
 type Database struct {
 	Conn *Connection
 	name string
+
+	writeConcern   *WriteConcern
+	readPreference *ReadPreference
+	ctx            Context // of the operations; nil if none
 }
 
 func (self *Database) GetCollection(name string) *Collection {
-	return &Collection{self, name}
+	return &Collection{db: self, name: name}
 }
 
 func (self *Database) Drop() os.Error {
@@ -30,22 +35,64 @@ func (self *Database) Drop() os.Error {
 }
 
 func (self *Database) Repair(preserveClonedFilesOnFailure, backupOriginalFiles bool) os.Error {
-	cmd := &_Object{
-		map[string]BSON{
-			"repairDatabase":               &_Number{1, _Null{}},
-			"preserveClonedFilesOnFailure": &_Boolean{preserveClonedFilesOnFailure, _Null{}},
-			"backupOriginalFiles":          &_Boolean{backupOriginalFiles, _Null{}},
-		},
-		_Null{},
+	cmd, err := Marshal(Doc{
+		{"repairDatabase", 1},
+		{"preserveClonedFilesOnFailure", preserveClonedFilesOnFailure},
+		{"backupOriginalFiles", backupOriginalFiles},
+	})
+	if err != nil {
+		return err
 	}
 
-	_, err := self.Command(cmd)
+	_, err = self.Command(cmd)
 	return err
 }
 
+/* A command that the server reported as failed, with ok set to 0. */
+type CommandError struct {
+	Name    string // command name, the first key of the command document
+	Code    int
+	Message string
+}
+
+func (self *CommandError) String() string {
+	msg := fmt.Sprintf("command %s failed: %s", self.Name, self.Message)
+	if self.Code != 0 {
+		msg += fmt.Sprintf(" (code %d)", self.Code)
+	}
+	return msg
+}
+
+/* Runs a command on the primary, returning a *CommandError if the server
+replies with {ok: 0}. */
 func (self *Database) Command(cmd BSON) (BSON, os.Error) {
+	return self.command(cmd, PrimaryOnly)
+}
+
+/* Runs a command on a member chosen by pref, which only commands that
+don't write, such as count, may take from their collection. */
+func (self *Database) command(cmd BSON, pref *ReadPreference) (BSON, os.Error) {
 	coll := self.GetCollection("$cmd")
-	return coll.FindOne(cmd)
+	coll.SetReadPreference(pref)
+	reply, err := coll.FindOne(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, commandError(cmd, reply)
+}
+
+/* Gets the *CommandError of a reply with {ok: 0}, or nil. */
+func commandError(cmd, reply BSON) os.Error {
+	if toInt(reply.Get("ok")) != 0 {
+		return nil
+	}
+
+	name := ""
+	if obj, ok := cmd.(*_Object); ok && len(obj.keys) > 0 {
+		name = obj.keys[0]
+	}
+	return &CommandError{name, toInt(reply.Get("code")), reply.Get("errmsg").String()}
 }
 
 func (self *Database) GetCollectionNames() *vector.StringVector {
@@ -0,0 +1,363 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* Decimal128
+
+IEEE 754-2008 128-bit decimal floating point numbers, with the significand
+as a binary integer (BID), as stored by MongoDB for NumberDecimal.
+
+https://github.com/mongodb/specifications/blob/master/source/bson-decimal128/decimal128.rst
+*/
+
+package mongo
+
+import (
+	"big"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+const (
+	decimal128Bias      = 6176
+	decimal128MinExp    = -6176
+	decimal128MaxExp    = 6111
+	decimal128MaxDigits = 34
+)
+
+/* A decimal number of up to 34 digits, with an exponent between -6176 and
+6111. Values are exact: converting from a string, a big.Int or a big.Rat
+fails rather than rounding, so money never goes through float64. */
+type Decimal128 struct {
+	h, l uint64 // high and low 64 bits
+}
+
+var (
+	Decimal128NaN    = Decimal128{0x7C00000000000000, 0}
+	Decimal128Inf    = Decimal128{0x7800000000000000, 0}
+	Decimal128NegInf = Decimal128{0xF800000000000000, 0}
+)
+
+var (
+	bigOne  = big.NewInt(1)
+	bigTwo  = big.NewInt(2)
+	bigFive = big.NewInt(5)
+	bigTen  = big.NewInt(10)
+
+	// Largest significand of 34 digits.
+	maxSignificand = new(big.Int).Sub(pow10(decimal128MaxDigits), bigOne)
+)
+
+func (self Decimal128) IsNaN() bool { return (self.h>>58)&0x1F == 0x1F }
+func (self Decimal128) IsInf() bool { return (self.h>>58)&0x1F == 0x1E }
+
+/* Reports whether the sign bit is set. Note that -0 is negative. */
+func (self Decimal128) Negative() bool { return self.h>>63 == 1 }
+
+/* Gets the significand and exponent of a finite number. */
+func (self Decimal128) parts() (*big.Int, int) {
+	if (self.h>>61)&3 == 3 {
+		// The significand would be 2^113 or more, over 34 digits: a
+		// non-canonical encoding of zero.
+		return new(big.Int), int((self.h>>47)&0x3FFF) - decimal128Bias
+	}
+
+	exp := int((self.h>>49)&0x3FFF) - decimal128Bias
+	coef := uint128(self.h&(1<<49-1), self.l)
+	if coef.Cmp(maxSignificand) > 0 {
+		coef = new(big.Int)
+	}
+	return coef, exp
+}
+
+/* Gets the number as significand * 10^exp. The significand has the sign of
+the number. ok is false for NaN and infinities. */
+func (self Decimal128) BigInt() (coef *big.Int, exp int, ok bool) {
+	if self.IsNaN() || self.IsInf() {
+		return nil, 0, false
+	}
+
+	coef, exp = self.parts()
+	if self.Negative() {
+		coef.Neg(coef)
+	}
+	return coef, exp, true
+}
+
+/* Gets the exact value of a finite number. ok is false for NaN and
+infinities. */
+func (self Decimal128) Rat() (r *big.Rat, ok bool) {
+	coef, exp, ok := self.BigInt()
+	if !ok {
+		return nil, false
+	}
+
+	if exp >= 0 {
+		return new(big.Rat).SetFrac(coef.Mul(coef, pow10(exp)), bigOne), true
+	}
+	return new(big.Rat).SetFrac(coef, pow10(-exp)), true
+}
+
+/* Formats the number following the decimal128 specification: plain
+notation for numbers of moderate size, scientific notation otherwise. */
+func (self Decimal128) String() string {
+	switch {
+	case self.IsNaN():
+		return "NaN"
+	case self.IsInf() && self.Negative():
+		return "-Infinity"
+	case self.IsInf():
+		return "Infinity"
+	}
+
+	coef, exp := self.parts()
+	digits := coef.String()
+	adjusted := exp + len(digits) - 1
+
+	var s string
+	switch {
+	case exp > 0 || adjusted < -6:
+		s = digits[0:1]
+		if len(digits) > 1 {
+			s += "." + digits[1:]
+		}
+		s += "E"
+		if adjusted >= 0 {
+			s += "+"
+		}
+		s += strconv.Itoa(adjusted)
+	case exp == 0:
+		s = digits
+	case len(digits) > -exp:
+		point := len(digits) + exp
+		s = digits[0:point] + "." + digits[point:]
+	default:
+		s = "0." + strings.Repeat("0", -exp-len(digits)) + digits
+	}
+
+	if self.Negative() {
+		return "-" + s
+	}
+	return s
+}
+
+/* Reports whether two numbers have the same value, whatever their
+precision: 1.0 equals 1.00 and -0 equals 0. NaN equals nothing. */
+func (self Decimal128) Equal(other Decimal128) bool {
+	switch {
+	case self.IsNaN() || other.IsNaN():
+		return false
+	case self.IsInf() || other.IsInf():
+		return self.IsInf() && other.IsInf() && self.Negative() == other.Negative()
+	}
+
+	a, aexp := self.parts()
+	b, bexp := other.parts()
+	if a.Sign() == 0 || b.Sign() == 0 {
+		return a.Sign() == b.Sign()
+	}
+	if self.Negative() != other.Negative() {
+		return false
+	}
+
+	// Bring both to the smaller exponent.
+	if aexp > bexp {
+		a.Mul(a, pow10(aexp-bexp))
+	} else {
+		b.Mul(b, pow10(bexp-aexp))
+	}
+	return a.Cmp(b) == 0
+}
+
+/* Parses a decimal number such as "-12.50", "1E+3", "Infinity" or "NaN".
+Numbers that can't be held exactly are an error. */
+func ParseDecimal128(s string) (Decimal128, os.Error) {
+	str := s
+	neg := false
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+
+	switch strings.ToLower(s) {
+	case "nan":
+		return Decimal128NaN, nil
+	case "inf", "infinity":
+		if neg {
+			return Decimal128NegInf, nil
+		}
+		return Decimal128Inf, nil
+	}
+
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return Decimal128NaN, decimalError(str, "bad exponent")
+		}
+		exp = e
+		s = s[0:i]
+	}
+
+	digits := s
+	if i := strings.Index(s, "."); i >= 0 {
+		digits = s[0:i] + s[i+1:]
+		exp -= len(s) - i - 1
+	}
+	if digits == "" {
+		return Decimal128NaN, decimalError(str, "no digits")
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return Decimal128NaN, decimalError(str, "bad digit")
+		}
+	}
+
+	coef, _ := new(big.Int).SetString(digits, 10)
+	d, err := newDecimal128(neg, coef, exp)
+	if err != nil {
+		return Decimal128NaN, decimalError(str, err.String())
+	}
+	return d, nil
+}
+
+/* Creates the number coef * 10^exp. */
+func NewDecimal128(coef *big.Int, exp int) (Decimal128, os.Error) {
+	neg := coef.Sign() < 0
+	return newDecimal128(neg, new(big.Int).Abs(coef), exp)
+}
+
+/* Creates a number with the exact value of r, which must have a finite
+decimal expansion: 1/4 can be converted but 1/3 can't. */
+func Decimal128FromRat(r *big.Rat) (Decimal128, os.Error) {
+	num := new(big.Int).Set(r.Num())
+	den := new(big.Int).Set(r.Denom())
+
+	// den divides 10^k if, and only if, it has no prime factors but 2 and 5.
+	twos := removeFactor(den, bigTwo)
+	fives := removeFactor(den, bigFive)
+	if den.Cmp(bigOne) != 0 {
+		return Decimal128NaN, os.NewError("decimal128: " + r.String() + " has no finite decimal expansion")
+	}
+
+	k := twos
+	if fives > k {
+		k = fives
+	}
+	coef := num.Mul(num, pow10(k))
+	coef.Div(coef, new(big.Int).Set(r.Denom()))
+	return NewDecimal128(coef, -k)
+}
+
+/* Creates the number with sign neg and value coef * 10^exp, coef being
+non-negative. The exponent is adjusted without losing digits if it is out
+of range; if that's not possible it is an error. */
+func newDecimal128(neg bool, coef *big.Int, exp int) (Decimal128, os.Error) {
+	coef = new(big.Int).Set(coef)
+
+	if coef.Sign() == 0 {
+		// Any exponent is as good for zero; clamp it.
+		if exp > decimal128MaxExp {
+			exp = decimal128MaxExp
+		} else if exp < decimal128MinExp {
+			exp = decimal128MinExp
+		}
+	} else {
+		if exp > decimal128MaxExp+decimal128MaxDigits {
+			return Decimal128NaN, os.NewError("overflow")
+		}
+
+		// Drop trailing zeros that don't fit in 34 digits or under the
+		// minimum exponent.
+		r := new(big.Int)
+		for coef.Cmp(maxSignificand) > 0 || exp < decimal128MinExp {
+			q, _ := new(big.Int).QuoRem(coef, bigTen, r)
+			if r.Sign() != 0 {
+				if exp < decimal128MinExp {
+					return Decimal128NaN, os.NewError("underflow")
+				}
+				return Decimal128NaN, os.NewError("more than 34 digits")
+			}
+			coef, exp = q, exp+1
+		}
+
+		// Add trailing zeros to bring a large exponent in range.
+		for exp > decimal128MaxExp {
+			coef.Mul(coef, bigTen)
+			exp--
+			if coef.Cmp(maxSignificand) > 0 {
+				return Decimal128NaN, os.NewError("overflow")
+			}
+		}
+	}
+
+	h, l := splitUint128(coef)
+	h |= uint64(exp+decimal128Bias) << 49
+	if neg {
+		h |= 1 << 63
+	}
+	return Decimal128{h, l}, nil
+}
+
+
+// === BSON value
+// ===
+
+type _Decimal128 struct {
+	value Decimal128
+	_Null
+}
+
+func (self *_Decimal128) Kind() int              { return Decimal128Kind }
+func (self *_Decimal128) Decimal128() Decimal128 { return self.value }
+func (self *_Decimal128) Bytes() []byte {
+	w := make([]byte, 2*_WORD64)
+	pack.PutUint64(w[0:8], self.value.l)
+	pack.PutUint64(w[8:16], self.value.h)
+	return w
+}
+
+
+// === Utility functions
+// ===
+
+func decimalError(s, msg string) os.Error {
+	return os.NewError("decimal128: can't parse " + strconv.Quote(s) + ": " + msg)
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+/* Divides x by f as many times as possible, returning how many. */
+func removeFactor(x, f *big.Int) int {
+	n := 0
+	q, r := new(big.Int), new(big.Int)
+	for {
+		q.QuoRem(x, f, r)
+		if r.Sign() != 0 {
+			return n
+		}
+		x.Set(q)
+		n++
+	}
+	panic("unreachable")
+}
+
+func uint128(h, l uint64) *big.Int {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[0:8], h)
+	binary.BigEndian.PutUint64(b[8:16], l)
+	return new(big.Int).SetBytes(b)
+}
+
+/* Splits a non-negative integer of up to 128 bits. */
+func splitUint128(x *big.Int) (h, l uint64) {
+	b := make([]byte, 16)
+	xb := x.Bytes()
+	copy(b[16-len(xb):], xb)
+	return binary.BigEndian.Uint64(b[0:8]), binary.BigEndian.Uint64(b[8:16])
+}
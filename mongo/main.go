@@ -7,6 +7,7 @@ package mongo
 import (
 	"encoding/binary"
 	"rand"
+	"sync"
 	//crand "crypto/rand"
 
 	crand "github.com/kless/freecrypto/rand" // under CC0 (like public domain)
@@ -22,7 +23,10 @@ var (
 	_WORD64 = 8
 )
 
-var lastRequestID int32
+var (
+	lastRequestID      int32
+	lastRequestIDMutex sync.Mutex
+)
 
 
 func init() {
@@ -49,10 +53,12 @@ func init() {
 To check anytime the server is sending a response ('opQuery', 'opGetMore').
 */
 func getRequestID() int32 {
-	id := rand.Int31()
+	lastRequestIDMutex.Lock()
+	defer lastRequestIDMutex.Unlock()
 
-	if id == lastRequestID {
-		return getRequestID()
+	id := rand.Int31()
+	for id == lastRequestID {
+		id = rand.Int31()
 	}
 	lastRequestID = id
 
@@ -12,8 +12,8 @@ package mongo
 import (
 	"bytes"
 	"container/vector"
-	"io"
-	"io/ioutil"
+	"fmt"
+	"os"
 )
 
 
@@ -114,22 +114,35 @@ func (self *opUpdate) Bytes() []byte {
 
 // === OP_INSERT
 
+// flags
+const (
+	// If set, the database will not stop processing a bulk insert if one
+	// fails (eg due to duplicate IDs).
+	f_CONTINUE_ON_ERROR = 0
+
+	// 1-31 - Reserved - Must be set to 0.
+)
+
 type opInsert struct {
 	//header           msgHeader // standard message header
-	//ZERO             int32     // 0 - reserved for future use
+	flags              int32  // bit vector. See above
 	fullCollectionName string // "dbname.collectionname"
-	documents          BSON   // one or more documents to insert into the collection
+	documents          []BSON // one or more documents to insert into the collection
 }
 
 func (self *opInsert) OpCode() int32 { return _OP_INSERT }
 
 func (self *opInsert) Bytes() []byte {
-	buf := bytes.NewBuffer(make([]byte, _WORD32)) // ZERO
+	w32 := make([]byte, _WORD32)
+	pack.PutUint32(w32, uint32(self.flags))
+	buf := bytes.NewBuffer(w32)
 
 	buf.WriteString(self.fullCollectionName)
 	buf.WriteByte(0)
 
-	buf.Write(self.documents.Bytes())
+	for _, doc := range self.documents {
+		buf.Write(doc.Bytes())
+	}
 
 	return buf.Bytes()
 }
@@ -139,14 +152,18 @@ func (self *opInsert) Bytes() []byte {
 // opts
 const (
 	o_NONE              = 0
-	o_TAILABLE_CURSOR   = 2
-	o_SLAVE_OK          = 4
-	o_NO_CURSOR_TIMEOUT = 16
+	o_TAILABLE_CURSOR   = 2   // keep the cursor open after the last document
+	o_SLAVE_OK          = 4   // allow reads from a secondary
+	o_NO_CURSOR_TIMEOUT = 16  // never time out the cursor when idle
+	o_AWAIT_DATA        = 32  // with a tailable cursor, block a while for new data
+	o_EXHAUST           = 64  // stream all batches without waiting for getMore
+	o_PARTIAL           = 128 // get partial results if some shards are down
 	//o_LOG_REPLAY        = 8 // drivers should not implement
 )
 
 // query
-//Possible elements include $query, $orderby, $hint, $explain, and $snapshot
+// Possible elements include $query, $orderby, $hint, $explain, and $snapshot;
+// see Query.
 
 type opQuery struct {
 	//header            msgHeader // standard message header
@@ -155,7 +172,8 @@ type opQuery struct {
 	numberToSkip       int32  // number of documents to skip
 	numberToReturn     int32  // number of documents to return in the first OP_REPLY batch
 	query              BSON   // query object.  See above
-	//returnFieldSelector BSON   // Optional. Selector indicating the fields to return.
+
+	returnFieldSelector BSON // Optional. Selector indicating the fields to return.
 }
 
 func (self *opQuery) OpCode() int32 { return _OP_QUERY }
@@ -178,6 +196,10 @@ func (self *opQuery) Bytes() []byte {
 
 	buf.Write(self.query.Bytes())
 
+	if self.returnFieldSelector != nil {
+		buf.Write(self.returnFieldSelector.Bytes())
+	}
+
 	return buf.Bytes()
 }
 
@@ -279,8 +301,27 @@ func (self *opKillCursors) Bytes() []byte {
 
 // === OP_REPLY
 
+// responseFlags
+const (
+	// Set when getMore is called but the cursor id is not valid at the server.
+	r_CURSOR_NOT_FOUND = 1
+
+	// Set when the query failed. The reply holds one document with an $err
+	// field describing the failure.
+	r_QUERY_FAILURE = 2
+
+	// Set by mongos when the shard configuration of the client is stale.
+	r_SHARD_CONFIG_STALE = 4
+
+	// Set when the server supports the AwaitData query option.
+	r_AWAIT_CAPABLE = 8
+
+	// 4-31 - Reserved - Ignore.
+)
+
 type opReply struct {
 	//header         msgHeader      // standard message header
+	requestID      int32          // !!! Added !!! what the next reply of an exhaust cursor responds to
 	responseTo     int32          // !!! Added !!!
 	responseFlag   int32          // normally zero, non-zero on query failure
 	cursorID       int64          // cursor id if client needs to do get more's
@@ -289,9 +330,20 @@ type opReply struct {
 	documents      *vector.Vector // documents
 }
 
-func parseReply(b []byte) *opReply {
+const _REPLY_SIZE = _HEADER_SIZE + 20 // header and fixed fields, without documents
+
+/* Parses a reply as read after its length prefix. */
+func parseReply(b []byte) (*opReply, os.Error) {
+	if len(b) < _REPLY_SIZE-4 {
+		return nil, os.NewError(fmt.Sprintf("reply of %d bytes is too short", len(b)+4))
+	}
+	if opCode := int32(pack.Uint32(b[8:12])); opCode != _OP_REPLY {
+		return nil, os.NewError(fmt.Sprintf("unexpected opCode %d in reply", opCode))
+	}
+
 	r := new(opReply)
 
+	r.requestID = int32(pack.Uint32(b[0:4]))
 	r.responseTo = int32(pack.Uint32(b[4:8]))
 	r.responseFlag = int32(pack.Uint32(b[12:16]))
 	r.cursorID = int64(pack.Uint64(b[16:24]))
@@ -299,20 +351,50 @@ func parseReply(b []byte) *opReply {
 	r.numberReturned = int32(pack.Uint32(b[28:32]))
 	r.documents = new(vector.Vector)
 
-	if r.numberReturned > 0 {
-		buf := bytes.NewBuffer(b[36:len(b)])
+	if r.numberReturned < 0 {
+		return nil, os.NewError(fmt.Sprintf("reply has %d documents", r.numberReturned))
+	}
 
-		for i := 0; int32(i) < r.numberReturned; i++ {
-			var bson BSON
-			bb := new(_BSONBuilder)
+	rest := b[_REPLY_SIZE-4:]
+	for i := int32(0); i < r.numberReturned; i++ {
+		if len(rest) < 5 {
+			return nil, os.NewError(fmt.Sprintf("reply truncated before document %d", i))
+		}
+		l := pack.Uint32(rest[0:4])
+		if l < 5 || l > uint32(len(rest)) {
+			return nil, os.NewError(fmt.Sprintf("bad length %d of document %d in reply", l, i))
+		}
 
-			bb.ptr = &bson
-			bb.Object()
-			Parse(buf, bb)
-			r.documents.Push(bson)
-			ioutil.ReadAll(io.LimitReader(buf, 4))
+		var bson BSON
+		bb := new(_BSONBuilder)
+		bb.ptr = &bson
+		bb.Object()
+		if err := parseDocument(rest[0:l], bb); err != nil {
+			return nil, err
 		}
+		r.documents.Push(bson)
+		rest = rest[l:]
+	}
+	if len(rest) > 0 {
+		return nil, os.NewError(fmt.Sprintf("%d trailing bytes in reply", len(rest)))
+	}
+
+	return r, nil
+}
+
+/* Gets the failure reported by the reply, if any. */
+func (self *opReply) err() os.Error {
+	if self.responseFlag&r_CURSOR_NOT_FOUND != 0 {
+		return ErrCursorNotFound
+	}
+
+	var doc BSON = Null
+	if self.documents.Len() > 0 {
+		doc = self.documents.At(0).(BSON)
+	}
+	if self.responseFlag&r_QUERY_FAILURE != 0 || doc.Get("$err").Kind() == StringKind {
+		return &QueryError{toInt(doc.Get("code")), doc.Get("$err").String()}
 	}
 
-	return r
+	return nil
 }
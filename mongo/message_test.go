@@ -0,0 +1,159 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"bytes"
+	"container/vector"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+/* Builds an OP_REPLY as read after the length prefix. */
+func replyBytes(responseTo, flags int32, cursorID int64, docs ...BSON) []byte {
+	w32 := make([]byte, _WORD32)
+	w64 := make([]byte, _WORD64)
+	buf := bytes.NewBuffer(w32) // requestID
+
+	pack.PutUint32(w32, uint32(responseTo))
+	buf.Write(w32)
+	pack.PutUint32(w32, _OP_REPLY)
+	buf.Write(w32)
+	pack.PutUint32(w32, uint32(flags))
+	buf.Write(w32)
+	pack.PutUint64(w64, uint64(cursorID))
+	buf.Write(w64)
+	pack.PutUint32(w32, 0) // startingFrom
+	buf.Write(w32)
+	pack.PutUint32(w32, uint32(len(docs)))
+	buf.Write(w32)
+
+	for _, doc := range docs {
+		buf.Write(doc.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+func TestReplyFlags(t *testing.T) {
+	doc, _ := Marshal(Doc{{"a", 1}})
+	reply, _ := parseReply(replyBytes(1, r_AWAIT_CAPABLE, 42, doc))
+	assertTrue(reply.err() == nil, "successful reply reported as failure", t)
+	cursor := newCursor(nil, reply)
+	assertTrue(cursor.AwaitCapable && !cursor.ShardConfigStale, "AwaitCapable flag", t)
+
+	reply, _ = parseReply(replyBytes(1, r_CURSOR_NOT_FOUND, 0))
+	assertTrue(reply.err() == ErrCursorNotFound, "CursorNotFound flag", t)
+
+	failure, _ := Marshal(Doc{{"$err", "bad query"}, {"code", 10068}})
+	reply, _ = parseReply(replyBytes(1, r_QUERY_FAILURE, 0, failure))
+	qerr, ok := reply.err().(*QueryError)
+	assertTrue(ok, fmt.Sprintf("QueryFailure flag gave %v", reply.err()), t)
+	if ok {
+		assertTrue(qerr.Code == 10068 && qerr.Message == "bad query", "QueryError fields", t)
+	}
+}
+
+/* Reads a reply from a socket whose server sends frame and hangs up. */
+func readFrom(frame []byte, options PoolOptions) (*opReply, os.Error) {
+	client, server := net.Pipe()
+	go func() {
+		server.Write(frame)
+		server.Close()
+	}()
+
+	sock := &socket{pool: &Pool{options: options}, conn: client}
+	defer client.Close()
+	return sock.readReply()
+}
+
+func framed(b []byte) []byte {
+	w32 := make([]byte, _WORD32)
+	pack.PutUint32(w32, uint32(len(b)+4))
+	return append(w32, b...)
+}
+
+func TestReadReplyFraming(t *testing.T) {
+	doc, _ := Marshal(Doc{{"a", "b"}})
+	good := framed(replyBytes(1, 0, 0, doc))
+
+	reply, err := readFrom(good, DefaultPoolOptions)
+	assertTrue(err == nil && reply.documents.Len() == 1, fmt.Sprintf("good frame: %v", err), t)
+
+	bad := map[string][]byte{
+		"empty":             []byte{},
+		"short length":      []byte{36, 0},
+		"length too small":  []byte{3, 0, 0, 0},
+		"truncated frame":   good[0 : len(good)-3],
+		"short header":      framed(replyBytes(1, 0, 0)[0:28]),
+		"trailing byte":     framed(append(replyBytes(1, 0, 0), 0)),
+	}
+	// Claims two documents but holds one.
+	twoDocs := replyBytes(1, 0, 0, doc)
+	pack.PutUint32(twoDocs[28:32], 2)
+	bad["document count"] = framed(twoDocs)
+	// A document whose length runs past the reply.
+	longDoc := replyBytes(1, 0, 0, doc)
+	pack.PutUint32(longDoc[32:36], 1000)
+	bad["document length"] = framed(longDoc)
+
+	for name, frame := range bad {
+		_, err := readFrom(frame, DefaultPoolOptions)
+		assertTrue(err != nil, "accepted bad frame: "+name, t)
+	}
+
+	_, err = readFrom(good, PoolOptions{MaxMessageSize: len(good) - 1})
+	assertTrue(err != nil, "accepted a reply over MaxMessageSize", t)
+}
+
+func TestQueryFieldSelector(t *testing.T) {
+	query, _ := Marshal(Doc{{"a", 1}})
+	fields, _ := Marshal(Doc{{"b", 1}})
+
+	whole := (&opQuery{o_NONE, "db.c", 0, 0, query, nil}).Bytes()
+	projected := (&opQuery{o_NONE, "db.c", 0, 0, query, fields}).Bytes()
+	assertTrue(bytes.Equal(projected, append(whole, fields.Bytes()...)), "field selector not after the query", t)
+}
+
+func TestExhaustCursor(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	pool := &Pool{options: DefaultPoolOptions}
+	coll := &Collection{db: &Database{Conn: &Connection{pool: pool}, name: "db"}, name: "c"}
+	sock := &socket{pool: pool, conn: client}
+
+	// The query got reply 7; the server streams the next ones without
+	// being asked, each in response to the one before.
+	doc, _ := Marshal(Doc{{"a", 1}})
+	go func() {
+		for i, id := range []int64{42, 0} {
+			frame := framed(replyBytes(int32(7+i), 0, id, doc))
+			pack.PutUint32(frame[4:8], uint32(8+i))
+			server.Write(frame)
+		}
+	}()
+
+	cursor := &Cursor{collection: coll, id: 42, docs: new(vector.Vector), sock: sock, requestID: 7}
+	n := 0
+	for cursor.HasMore() {
+		cursor.GetNext()
+		n++
+	}
+	assertTrue(n == 2, fmt.Sprintf("exhaust cursor gave %d documents", n), t)
+	assertTrue(cursor.sock == nil && len(pool.idle) == 1, "socket not given back after the last batch", t)
+}
+
+func TestInsertMessage(t *testing.T) {
+	a, _ := Marshal(Doc{{"a", 1}})
+	b, _ := Marshal(Doc{{"b", 2}})
+
+	msg := (&opInsert{fContinueOnError, "db.c", []BSON{a, b}}).Bytes()
+	assertTrue(pack.Uint32(msg[0:4]) == 1, "ContinueOnError flag", t)
+	assertTrue(string(msg[4:9]) == "db.c\x00", "collection name", t)
+	assertTrue(bytes.Equal(msg[9:], append(a.Bytes(), b.Bytes()...)), "documents", t)
+}
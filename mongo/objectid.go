@@ -0,0 +1,118 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* ObjectId
+
+http://www.mongodb.org/display/DOCS/Object+IDs
+
+An ObjectId is 12 bytes, all big-endian:
+
+	4 bytes: seconds since the epoch
+	3 bytes: machine identifier
+	2 bytes: process id
+	3 bytes: counter, starting at a random value
+*/
+
+package mongo
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"rand"
+	"sync"
+	"time"
+)
+
+
+type ObjectId []byte
+
+var (
+	machineId []byte // first 3 bytes of the MD5 of the host name
+
+	objectIdCounter      uint32
+	objectIdCounterMutex sync.Mutex
+)
+
+func init() {
+	hostname, err := os.Hostname()
+	if err != nil {
+		// Better a random machine id than none.
+		hostname = fmt.Sprint(rand.Int63())
+	}
+	h := md5.New()
+	h.Write([]byte(hostname))
+	machineId = h.Sum()[0:3]
+
+	objectIdCounter = rand.Uint32()
+}
+
+/* Creates a new, unique ObjectId. */
+func NewObjectId() ObjectId {
+	id := make([]byte, 12)
+
+	binary.BigEndian.PutUint32(id[0:4], uint32(time.Seconds()))
+	copy(id[4:7], machineId)
+
+	pid := os.Getpid()
+	id[7] = byte(pid >> 8)
+	id[8] = byte(pid)
+
+	objectIdCounterMutex.Lock()
+	objectIdCounter++
+	i := objectIdCounter
+	objectIdCounterMutex.Unlock()
+
+	id[9] = byte(i >> 16)
+	id[10] = byte(i >> 8)
+	id[11] = byte(i)
+
+	return ObjectId(id)
+}
+
+/* Gets the ObjectId from its 24 hex digits form. */
+func ObjectIdHex(s string) (ObjectId, os.Error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 12 {
+		return nil, os.NewError(fmt.Sprintf("invalid ObjectId %q", s))
+	}
+	return ObjectId(b), nil
+}
+
+func (self ObjectId) Valid() bool { return len(self) == 12 }
+
+func (self ObjectId) Hex() string { return hex.EncodeToString(self) }
+
+func (self ObjectId) String() string { return fmt.Sprintf("ObjectIdHex(%q)", self.Hex()) }
+
+/* Gets the creation time of the id, in seconds since the epoch. */
+func (self ObjectId) Timestamp() int64 {
+	if !self.Valid() {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint32(self[0:4]))
+}
+
+/* Gets doc with an _id, adding a new ObjectId as first element if it has
+none. doc itself is left unchanged. */
+func withId(doc BSON) (BSON, BSON) {
+	obj, ok := doc.(*_Object)
+	if !ok {
+		return doc, doc.Get("_id")
+	}
+	if id, ok := obj.value["_id"]; ok {
+		return doc, id
+	}
+
+	id := &_OID{NewObjectId(), _Null{}}
+	o := newObject()
+	o.Set("_id", id)
+	for _, k := range obj.keys {
+		o.Set(k, obj.value[k])
+	}
+
+	return o, id
+}
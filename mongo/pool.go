@@ -0,0 +1,464 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+
+type PoolOptions struct {
+	// Number of sockets opened up front and kept open while idle.
+	MinSockets int
+
+	// Upper bound on the number of open sockets. When every socket is in
+	// use, callers wait for one to be checked in. Zero means no limit.
+	MaxSockets int
+
+	// Nanoseconds an idle socket above MinSockets is kept open before being
+	// closed. Zero keeps idle sockets open forever.
+	MaxIdleTime int64
+
+	// Largest reply accepted, in bytes. Zero means DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	// Nanoseconds to wait for a new socket to connect, and for each read
+	// and write on a socket. Zero means no timeout. A socket that times out
+	// is closed.
+	ConnectTimeout int64
+	ReadTimeout    int64
+	WriteTimeout   int64
+}
+
+// Largest reply accepted by default, as the server never sends more.
+const DefaultMaxMessageSize = 48 * 1024 * 1024
+
+var DefaultPoolOptions = PoolOptions{
+	MinSockets:     0,
+	MaxSockets:     100,
+	MaxIdleTime:    60e9,
+	MaxMessageSize: DefaultMaxMessageSize,
+}
+
+var errPoolClosed = os.NewError("connection pool is closed")
+
+/* A pool of sockets to a single server.
+
+A socket is checked out for the length of one operation, so there is never
+more than one request in flight on it and every reply can be matched against
+the request that produced it. It is safe to use a Pool from many goroutines.
+*/
+type Pool struct {
+	Addr    *net.TCPAddr
+	options PoolOptions
+	dialer  *dialer
+
+	mutex  sync.Mutex
+	idle   []*socket // most recently used at the end
+	open   int       // idle and checked out sockets
+	closed bool
+
+	slots chan bool // one element per checked out socket; nil if unbounded
+	done  chan bool // stops the idle sockets janitor
+
+	credentials []*credential // every socket logs in with, one per database
+}
+
+/* Creates a pool of sockets to addr, opening MinSockets sockets (at least
+one, so an unreachable server is reported at once). */
+func NewPool(addr *net.TCPAddr, options PoolOptions) (*Pool, os.Error) {
+	return newPool(addr, options, &dialer{})
+}
+
+func newPool(addr *net.TCPAddr, options PoolOptions, d *dialer) (*Pool, os.Error) {
+	if options.MinSockets < 0 || options.MaxSockets < 0 ||
+		(options.MaxSockets > 0 && options.MinSockets > options.MaxSockets) {
+		return nil, os.NewError("invalid pool options")
+	}
+
+	self := &Pool{Addr: addr, options: options, dialer: d}
+	if options.MaxSockets > 0 {
+		self.slots = make(chan bool, options.MaxSockets)
+	}
+
+	n := options.MinSockets
+	if n == 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		sock, err := self.dial()
+		if err != nil {
+			self.Close()
+			return nil, err
+		}
+		sock.lastUsed = time.Nanoseconds()
+		self.idle = append(self.idle, sock)
+	}
+
+	if options.MaxIdleTime > 0 {
+		self.done = make(chan bool)
+		go self.janitor()
+	}
+
+	return self, nil
+}
+
+/* Closes every idle socket. Sockets in use are closed as they are checked
+in. */
+func (self *Pool) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return
+	}
+	self.closed = true
+
+	for _, sock := range self.idle {
+		sock.close()
+	}
+	self.idle = nil
+
+	if self.done != nil {
+		close(self.done)
+	}
+}
+
+type PoolStats struct {
+	Open int // sockets open, idle or in use
+	Idle int // sockets waiting in the pool
+}
+
+func (self *Pool) Stats() PoolStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return PoolStats{self.open, len(self.idle)}
+}
+
+/* Gets a socket for the exclusive use of the caller, who must give it back
+with checkin. It waits for a free one when MaxSockets are in use. The socket
+is logged in with the credentials of the pool, and killed if ctx is done
+before it is checked in; ctx may be nil. */
+func (self *Pool) checkout(ctx Context) (*socket, os.Error) {
+	sock, err := self.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sock.watch(ctx)
+
+	if err = self.authenticate(sock); err != nil {
+		self.checkin(sock)
+		return nil, err
+	}
+	return sock, nil
+}
+
+func (self *Pool) get(ctx Context) (*socket, os.Error) {
+	if ctx != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if self.slots != nil {
+		select {
+		case self.slots <- true:
+		case <-doneOf(ctx):
+			return nil, ctx.Err()
+		}
+	}
+
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		self.release()
+		return nil, errPoolClosed
+	}
+	if n := len(self.idle); n > 0 {
+		sock := self.idle[n-1]
+		self.idle = self.idle[0 : n-1]
+		self.mutex.Unlock()
+		return sock, nil
+	}
+	self.mutex.Unlock()
+
+	sock, err := self.dial()
+	if err != nil {
+		self.release()
+		return nil, err
+	}
+	return sock, nil
+}
+
+/* Gives back a socket got from checkout. Dead sockets are closed instead of
+being reused. */
+func (self *Pool) checkin(sock *socket) {
+	sock.unwatch()
+
+	self.mutex.Lock()
+	if self.closed || sock.dead {
+		sock.close()
+	} else {
+		sock.lastUsed = time.Nanoseconds()
+		self.idle = append(self.idle, sock)
+	}
+	self.mutex.Unlock()
+
+	self.release()
+}
+
+func (self *Pool) release() {
+	if self.slots != nil {
+		<-self.slots
+	}
+}
+
+func (self *Pool) dial() (*socket, os.Error) {
+	conn, err := self.dialer.dial(self.Addr, self.options.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if self.options.ReadTimeout > 0 {
+		conn.SetReadTimeout(self.options.ReadTimeout)
+	}
+	if self.options.WriteTimeout > 0 {
+		conn.SetWriteTimeout(self.options.WriteTimeout)
+	}
+
+	self.mutex.Lock()
+	self.open++
+	self.mutex.Unlock()
+
+	return &socket{pool: self, conn: conn}, nil
+}
+
+/* Closes the sockets that have been idle longer than MaxIdleTime, keeping
+at least MinSockets open. The caller must hold the mutex. */
+func (self *Pool) evictIdle(now int64) {
+	// The oldest sockets are at the front.
+	n := 0
+	for n < len(self.idle) && self.open > self.options.MinSockets &&
+		now-self.idle[n].lastUsed > self.options.MaxIdleTime {
+		self.idle[n].close()
+		n++
+	}
+	self.idle = self.idle[n:]
+}
+
+func (self *Pool) janitor() {
+	ticker := time.NewTicker(self.options.MaxIdleTime / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case now := <-ticker.C:
+			self.mutex.Lock()
+			self.evictIdle(now)
+			self.mutex.Unlock()
+		}
+	}
+}
+
+
+// === Dialing
+// ===
+
+/* How new sockets are opened. */
+type dialer struct {
+	tls *tls.Config // nil for plain TCP
+}
+
+/* Opens a socket to addr, giving up after timeout nanoseconds unless it is
+zero. The timeout covers the TLS handshake as well. */
+func (self *dialer) dial(addr *net.TCPAddr, timeout int64) (net.Conn, os.Error) {
+	tcp, err := dialTCP(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn = tcp
+	if self.tls != nil {
+		if timeout > 0 {
+			tcp.SetTimeout(timeout)
+		}
+		tlsConn := tls.Client(tcp, self.tls)
+		if err = tlsConn.Handshake(); err != nil {
+			tcp.Close()
+			return nil, err
+		}
+		tcp.SetTimeout(0)
+		conn = tlsConn
+	}
+
+	return conn, nil
+}
+
+func dialTCP(addr *net.TCPAddr, timeout int64) (*net.TCPConn, os.Error) {
+	if timeout <= 0 {
+		// Connects from local host (nil)
+		return net.DialTCP("tcp", nil, addr)
+	}
+
+	type dialResult struct {
+		conn *net.TCPConn
+		err  os.Error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, err := net.DialTCP("tcp", nil, addr)
+		result <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// Don't leak the socket if the dial completes later on.
+		go func() {
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+	}
+	return nil, os.NewError(fmt.Sprintf("timed out connecting to %v", addr))
+}
+
+
+// === Sockets
+// ===
+
+type socket struct {
+	pool     *Pool
+	conn     net.Conn
+	lastUsed int64 // nanoseconds; set when checked in
+	dead     bool  // an I/O error left the socket in an unknown state
+
+	logins map[string]*credential // by database
+
+	// Context of the operation the socket is checked out for, if any, and
+	// the goroutine that kills the socket when it is done.
+	ctx    Context
+	stop   chan bool
+	killed chan bool
+}
+
+/* Closes the connection. The caller must hold the pool's mutex, if the
+socket belongs to a pool. */
+func (self *socket) close() {
+	self.conn.Close()
+	if self.pool != nil {
+		self.pool.open--
+	}
+}
+
+/* Closes the connection when ctx is done, until unwatch is called. The
+read or write in flight then fails at once, and the socket is dead. */
+func (self *socket) watch(ctx Context) {
+	if ctx == nil {
+		return
+	}
+
+	self.ctx = ctx
+	self.stop = make(chan bool)
+	self.killed = make(chan bool, 1)
+	go func(stop, killed chan bool) {
+		select {
+		case <-ctx.Done():
+			self.conn.Close()
+			killed <- true
+		case <-stop:
+			killed <- false
+		}
+	}(self.stop, self.killed)
+}
+
+func (self *socket) unwatch() {
+	if self.ctx == nil {
+		return
+	}
+
+	close(self.stop)
+	if <-self.killed {
+		self.dead = true
+	}
+	self.ctx, self.stop, self.killed = nil, nil, nil
+}
+
+/* Marks the socket dead after the I/O error err, which is reported as the
+error of the context if that is why it happened. */
+func (self *socket) ioError(err os.Error) os.Error {
+	self.dead = true
+	if self.ctx != nil {
+		if ctxErr := self.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+	}
+	return err
+}
+
+/* Sends a message that gets no reply. */
+func (self *socket) send(m message) os.Error {
+	_, err := self.write(m)
+	return err
+}
+
+/* Sends a message and reads the reply to it. */
+func (self *socket) roundTrip(m message) (*opReply, os.Error) {
+	reqID, err := self.write(m)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := self.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if reply.responseTo != reqID {
+		// Whatever is left on the wire can't be trusted anymore.
+		self.dead = true
+		return nil, os.NewError("wrong responseTo code")
+	}
+	if err = reply.err(); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+/* Reads the next reply of an exhaust cursor, which the server sends in
+response to the previous reply, requestID. */
+func (self *socket) readMore(requestID int32) (*opReply, os.Error) {
+	reply, err := self.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if reply.responseTo != requestID {
+		self.dead = true
+		return nil, os.NewError("wrong responseTo code")
+	}
+	if err = reply.err(); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (self *socket) write(m message) (int32, os.Error) {
+	reqID := getRequestID()
+	body := m.Bytes()
+	h := header(msgHeader{int32(len(body) + _HEADER_SIZE), reqID, 0, m.OpCode()})
+
+	msg := append(h, body...)
+	if _, err := self.conn.Write(msg); err != nil {
+		return 0, self.ioError(err)
+	}
+
+	return reqID, nil
+}
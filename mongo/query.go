@@ -0,0 +1,344 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"os"
+	"strings"
+)
+
+
+var ErrNotFound = os.NewError("not found")
+
+/* A query being built, as returned by Collection.Find. The settings are
+chained and the query runs on One, All, Iter, Count or Explain:
+
+	err := coll.Find(q).Sort("-age", "name").Skip(10).Limit(50).All(&people)
+*/
+type Query struct {
+	collection *Collection
+	filter     interface{}
+	fields     interface{}
+
+	sort      Doc
+	hint      interface{}
+	comment   string
+	maxTimeMS int64
+	snapshot  bool
+
+	skip, limit, batch int32
+	opts               int32
+}
+
+/* Starts a query for the documents matching filter, which is anything
+Marshal takes. nil matches all documents. */
+func (self *Collection) Find(filter interface{}) *Query {
+	return &Query{collection: self, filter: filter}
+}
+
+/* Orders the results by the given keys, in order. A key prefixed with '-'
+sorts in descending order. */
+func (self *Query) Sort(keys ...string) *Query {
+	self.sort = nil
+	for _, k := range keys {
+		order := 1
+		switch {
+		case strings.HasPrefix(k, "-"):
+			k, order = k[1:], -1
+		case strings.HasPrefix(k, "+"):
+			k = k[1:]
+		}
+		self.sort = append(self.sort, DocElem{k, order})
+	}
+	return self
+}
+
+/* Forces the use of an index, given by its name or its key document. */
+func (self *Query) Hint(index interface{}) *Query {
+	self.hint = index
+	return self
+}
+
+func (self *Query) Skip(n int) *Query {
+	self.skip = int32(n)
+	return self
+}
+
+/* Returns at most n documents. Zero means no limit, and a negative n gets
+at most -n documents in a single batch, closing the cursor at once. */
+func (self *Query) Limit(n int) *Query {
+	self.limit = int32(n)
+	return self
+}
+
+/* Sets how many documents the server returns per batch, for the first one
+and every getMore. Zero leaves it to the server. */
+func (self *Query) Batch(n int) *Query {
+	self.batch = int32(n)
+	return self
+}
+
+/* Returns only the fields selected, as with Collection.QueryFields. */
+func (self *Query) Select(fields interface{}) *Query {
+	self.fields = fields
+	return self
+}
+
+/* Attaches a comment to the query, as seen in the profiler and the logs. */
+func (self *Query) Comment(comment string) *Query {
+	self.comment = comment
+	return self
+}
+
+/* Makes the server give up on the query after ms milliseconds. */
+func (self *Query) MaxTimeMS(ms int64) *Query {
+	self.maxTimeMS = ms
+	return self
+}
+
+/* Makes sure no document is returned twice, even if moved by an update. */
+func (self *Query) Snapshot() *Query {
+	self.snapshot = true
+	return self
+}
+
+/* Keeps the cursor open after the last document of a capped collection,
+to get the documents inserted later. */
+func (self *Query) Tailable() *Query {
+	self.opts |= o_TAILABLE_CURSOR
+	return self
+}
+
+/* With Tailable, has the server wait a while for new documents rather than
+return an empty batch at once. */
+func (self *Query) AwaitData() *Query {
+	self.opts |= o_AWAIT_DATA
+	return self
+}
+
+/* Allows the query to run on a secondary. */
+func (self *Query) SlaveOk() *Query {
+	self.opts |= o_SLAVE_OK
+	return self
+}
+
+/* Keeps the cursor open on the server however long it is idle. Such a
+cursor must be closed. */
+func (self *Query) NoCursorTimeout() *Query {
+	self.opts |= o_NO_CURSOR_TIMEOUT
+	return self
+}
+
+/* Has the server send all the batches at once, without waiting for each
+getMore. The cursor holds a socket of its own until the last batch. */
+func (self *Query) Exhaust() *Query {
+	self.opts |= o_EXHAUST
+	return self
+}
+
+/* Gets the results of the shards that are up, rather than an error, when
+some shards of a sharded cluster are down. */
+func (self *Query) Partial() *Query {
+	self.opts |= o_PARTIAL
+	return self
+}
+
+
+// === Running the query
+// ===
+
+/* Decodes the first document into result, which is a *BSON or anything
+Unmarshal takes. Returns ErrNotFound if no document matches. */
+func (self *Query) One(result interface{}) os.Error {
+	op, err := self.op(false)
+	if err != nil {
+		return err
+	}
+	op.numberToReturn = -1
+
+	cursor, err := self.collection.query(op)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	doc, err := cursor.GetNext()
+	if err == os.EOF {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return decode(doc, result)
+}
+
+/* Decodes all the documents into result, a pointer to a slice of BSON or of
+anything Unmarshal takes. */
+func (self *Query) All(result interface{}) os.Error {
+	return self.Iter().All(result)
+}
+
+/* Runs the query and gets a cursor on its results. A failure is reported
+by the cursor. */
+func (self *Query) Iter() *Cursor {
+	op, err := self.op(false)
+	if err != nil {
+		return errCursor(self.collection, err)
+	}
+
+	cursor, err := self.collection.query(op)
+	if err != nil {
+		return errCursor(self.collection, err)
+	}
+	cursor.limit = abs32(self.limit)
+	cursor.batchSize = self.batch
+	return cursor
+}
+
+/* Counts the documents matching the query, taking skip and limit into
+account. */
+func (self *Query) Count() (int64, os.Error) {
+	filter, err := self.marshalFilter()
+	if err != nil {
+		return -1, err
+	}
+
+	cmd := Doc{{"count", self.collection.name}, {"query", filter}}
+	if self.skip != 0 {
+		cmd = append(cmd, DocElem{"skip", self.skip})
+	}
+	if self.limit != 0 {
+		cmd = append(cmd, DocElem{"limit", abs32(self.limit)})
+	}
+	if self.hint != nil {
+		cmd = append(cmd, DocElem{"hint", self.hint})
+	}
+	if self.maxTimeMS != 0 {
+		cmd = append(cmd, DocElem{"maxTimeMS", self.maxTimeMS})
+	}
+
+	b, err := Marshal(cmd)
+	if err != nil {
+		return -1, err
+	}
+	reply, err := self.collection.db.command(b, self.collection.ReadPreference())
+	if err != nil {
+		return -1, err
+	}
+	return int64(toInt(reply.Get("n"))), nil
+}
+
+/* Decodes into result how the server runs the query, as One does. */
+func (self *Query) Explain(result interface{}) os.Error {
+	op, err := self.op(true)
+	if err != nil {
+		return err
+	}
+	// The explanation comes back in a single batch.
+	if op.numberToReturn > 0 {
+		op.numberToReturn = -op.numberToReturn
+	}
+
+	cursor, err := self.collection.query(op)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	doc, err := cursor.GetNext()
+	if err == os.EOF {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return decode(doc, result)
+}
+
+func (self *Query) marshalFilter() (BSON, os.Error) {
+	if self.filter == nil {
+		return EmptyObject, nil
+	}
+	return Marshal(self.filter)
+}
+
+/* Builds the OP_QUERY message. Modifiers such as $orderby need the filter
+to be wrapped in $query. */
+func (self *Query) op(explain bool) (*opQuery, os.Error) {
+	filter, err := self.marshalFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	var mods Doc
+	if self.sort != nil {
+		mods = append(mods, DocElem{"$orderby", self.sort})
+	}
+	if self.hint != nil {
+		mods = append(mods, DocElem{"$hint", self.hint})
+	}
+	if self.comment != "" {
+		mods = append(mods, DocElem{"$comment", self.comment})
+	}
+	if self.maxTimeMS != 0 {
+		mods = append(mods, DocElem{"$maxTimeMS", self.maxTimeMS})
+	}
+	if self.snapshot {
+		mods = append(mods, DocElem{"$snapshot", true})
+	}
+	if explain {
+		mods = append(mods, DocElem{"$explain", true})
+	}
+
+	query := filter
+	if mods != nil {
+		query, err = Marshal(append(Doc{{"$query", filter}}, mods...))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fields BSON
+	if self.fields != nil {
+		if fields, err = Marshal(self.fields); err != nil {
+			return nil, err
+		}
+	}
+
+	n := numberToReturn(self.limit, self.batch)
+	return &opQuery{self.opts, self.collection.fullName(), self.skip, n, query, fields}, nil
+}
+
+/* Gets the numberToReturn of a batch: batch documents, but no more than
+limit. A negative limit asks for a single batch of -limit documents. */
+func numberToReturn(limit, batch int32) int32 {
+	if limit < 0 {
+		return limit
+	}
+	if batch == 1 {
+		// The server takes 1 as -1, and would close the cursor.
+		batch = 2
+	}
+	if limit > 0 && (batch == 0 || limit < batch) {
+		return limit
+	}
+	return batch
+}
+
+func abs32(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+/* Stores doc in result, a *BSON or anything Unmarshal takes. */
+func decode(doc BSON, result interface{}) os.Error {
+	if p, ok := result.(*BSON); ok {
+		*p = doc
+		return nil
+	}
+	return Unmarshal(doc.Bytes(), result)
+}
@@ -0,0 +1,100 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"container/vector"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestQueryMessage(t *testing.T) {
+	coll := &Collection{db: &Database{name: "db"}, name: "people"}
+	filter := Doc{{"age", Doc{{"$gt", 18}}}}
+
+	op, err := coll.Find(filter).Skip(10).Limit(50).op(false)
+	assertTrue(err == nil, fmt.Sprintf("op: %v", err), t)
+	plain, _ := Marshal(filter)
+	assertTrue(Equal(op.query, plain), "filter wrapped without modifiers", t)
+	assertTrue(op.numberToSkip == 10 && op.numberToReturn == 50, "skip and limit", t)
+	assertTrue(op.fullCollectionName == "db.people" && op.returnFieldSelector == nil, "collection and fields", t)
+
+	op, _ = coll.Find(filter).Sort("-age", "name").Hint("age_1").Comment("adults").MaxTimeMS(500).Snapshot().op(true)
+	expected, _ := Marshal(Doc{
+		{"$query", filter},
+		{"$orderby", Doc{{"age", -1}, {"name", 1}}},
+		{"$hint", "age_1"},
+		{"$comment", "adults"},
+		{"$maxTimeMS", int64(500)},
+		{"$snapshot", true},
+		{"$explain", true},
+	})
+	assertTrue(Equal(op.query, expected), fmt.Sprintf("modifiers: %v", op.query), t)
+
+	op, _ = coll.Find(nil).Limit(50).Batch(20).Select(Doc{{"name", 1}}).op(false)
+	assertTrue(Equal(op.query, EmptyObject), "nil filter", t)
+	assertTrue(op.numberToReturn == 20, "batch smaller than limit", t)
+	assertTrue(op.returnFieldSelector.Get("name").Long() == 1, "select", t)
+
+	op, _ = coll.Find(nil).Limit(5).Batch(20).op(false)
+	assertTrue(op.numberToReturn == 5, "limit smaller than batch", t)
+}
+
+func TestNumberToReturn(t *testing.T) {
+	cases := [][3]int32{
+		// limit, batch, numberToReturn
+		{0, 0, 0},
+		{0, 100, 100},
+		{50, 0, 50},
+		{50, 100, 50},
+		{50, 20, 20},
+		{-5, 20, -5},
+		{0, 1, 2},
+		{1, 0, 1},
+	}
+	for _, c := range cases {
+		n := numberToReturn(c[0], c[1])
+		assertTrue(n == c[2], fmt.Sprintf("limit %d, batch %d: %d instead of %d", c[0], c[1], n, c[2]), t)
+	}
+}
+
+/* Gets a cursor on docs, as a reply with no more batches. */
+func cursorOn(docs ...interface{}) *Cursor {
+	v := new(vector.Vector)
+	for _, d := range docs {
+		b, _ := Marshal(d)
+		v.Push(b)
+	}
+	return &Cursor{docs: v}
+}
+
+func TestCursorIteration(t *testing.T) {
+	cursor := cursorOn(&Person{"ann", 20}, &Person{"bob", 21})
+	var p Person
+	names := ""
+	for cursor.Next(&p) {
+		names += p.Name
+	}
+	assertTrue(names == "annbob" && cursor.Err() == nil, fmt.Sprintf("Next: %q, %v", names, cursor.Err()), t)
+	_, err := cursor.GetNext()
+	assertTrue(err == os.EOF, fmt.Sprintf("GetNext after the last document: %v", err), t)
+
+	var people []Person
+	err = cursorOn(&Person{"ann", 20}, &Person{"bob", 21}).All(&people)
+	assertTrue(err == nil && len(people) == 2 && people[1].Age == 21, fmt.Sprintf("All: %v, %v", people, err), t)
+
+	var docs []BSON
+	err = cursorOn(Doc{{"a", 1}}).All(&docs)
+	assertTrue(err == nil && len(docs) == 1 && docs[0].Get("a").Long() == 1, "All BSON", t)
+
+	// A document that can't be decoded stops the iteration.
+	cursor = cursorOn(Doc{{"color", "mauve"}}, Doc{{"color", "red"}})
+	var o Order
+	assertTrue(!cursor.Next(&o) && cursor.Err() != nil, "decoding failure not reported", t)
+
+	failed := errCursor(nil, ErrCursorNotFound)
+	assertTrue(!failed.Next(&p) && failed.Err() == ErrCursorNotFound, "query failure not reported", t)
+}
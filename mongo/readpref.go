@@ -0,0 +1,329 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* Read preferences
+
+http://www.mongodb.org/display/DOCS/Read+Preferences
+
+Queries go to the primary unless a read preference lets them go to the
+secondaries. Such queries are sent with the slaveOk bit set; through a
+single server, which may be a mongos, the preference is also sent with the
+query, as $readPreference.
+*/
+
+package mongo
+
+import (
+	"fmt"
+	"os"
+	"rand"
+)
+
+
+var ErrNoMember = os.NewError("no member of the replica set matches the read preference")
+
+// Read preference modes.
+const (
+	ReadPrimary            = "primary"
+	ReadPrimaryPreferred   = "primaryPreferred"
+	ReadSecondary          = "secondary"
+	ReadSecondaryPreferred = "secondaryPreferred"
+	ReadNearest            = "nearest"
+)
+
+// Smallest max staleness, in seconds, that the servers accept.
+const MinMaxStaleness = 90
+
+// Nanoseconds of round trip over the nearest member within which the
+// members are taken as near as well.
+const localThreshold = 15e6
+
+/* Which members of a replica set queries are read from. */
+type ReadPreference struct {
+	Mode string              // one of the Read* modes; ReadPrimary if empty
+	Tags []map[string]string // tag sets, in order of preference; an empty set matches any member
+
+	// Seconds a secondary may lag behind the primary. Zero means no limit.
+	MaxStaleness int64
+}
+
+var PrimaryOnly = &ReadPreference{Mode: ReadPrimary}
+
+func (self *ReadPreference) mode() string {
+	if self.Mode == "" {
+		return ReadPrimary
+	}
+	return self.Mode
+}
+
+func (self *ReadPreference) validate() os.Error {
+	switch self.mode() {
+	case ReadPrimary:
+		if len(self.Tags) > 0 || self.MaxStaleness > 0 {
+			return os.NewError("tags and max staleness can't be used with primary read preference")
+		}
+	case ReadPrimaryPreferred, ReadSecondary, ReadSecondaryPreferred, ReadNearest:
+	default:
+		return os.NewError("unknown read preference " + self.Mode)
+	}
+
+	if self.MaxStaleness > 0 && self.MaxStaleness < MinMaxStaleness {
+		return os.NewError(fmt.Sprintf("max staleness must be at least %d seconds", MinMaxStaleness))
+	}
+	return nil
+}
+
+/* Gets the $readPreference document sent to a mongos. */
+func (self *ReadPreference) document() Doc {
+	doc := Doc{{"mode", self.mode()}}
+	if len(self.Tags) > 0 {
+		doc = append(doc, DocElem{"tags", self.Tags})
+	}
+	if self.MaxStaleness > 0 {
+		doc = append(doc, DocElem{"maxStalenessSeconds", self.MaxStaleness})
+	}
+	return doc
+}
+
+
+// === Setting the read preference
+// ===
+
+/* Sets the read preference of the collections got from this connection
+that don't set their own. nil restores the default, PrimaryOnly. */
+func (self *Connection) SetReadPreference(pref *ReadPreference) {
+	self.readPreference = pref
+}
+
+func (self *Connection) ReadPreference() *ReadPreference {
+	if self.readPreference == nil {
+		return PrimaryOnly
+	}
+	return self.readPreference
+}
+
+/* Sets the read preference of the collections got from this database. nil
+falls back to the connection's. */
+func (self *Database) SetReadPreference(pref *ReadPreference) {
+	self.readPreference = pref
+}
+
+func (self *Database) ReadPreference() *ReadPreference {
+	if self.readPreference == nil {
+		return self.Conn.ReadPreference()
+	}
+	return self.readPreference
+}
+
+/* Sets the read preference of this collection. nil falls back to the
+database's. */
+func (self *Collection) SetReadPreference(pref *ReadPreference) {
+	self.readPreference = pref
+}
+
+func (self *Collection) ReadPreference() *ReadPreference {
+	if self.readPreference == nil {
+		return self.db.ReadPreference()
+	}
+	return self.readPreference
+}
+
+
+// === Reading
+// ===
+
+/* Gets the pool of the server to read from following pref. A single
+server is always read from. */
+func (self *Connection) readPool(pref *ReadPreference) (*Pool, os.Error) {
+	if self.replset != nil {
+		return self.replset.selectPool(pref)
+	}
+	return self.pool, nil
+}
+
+/* Gets msg as sent following pref: with the slaveOk bit unless it reads
+from the primary, and with $readPreference through a single server. */
+func (self *Connection) readQuery(msg *opQuery, pref *ReadPreference) (*opQuery, os.Error) {
+	mode := pref.mode()
+	if mode == ReadPrimary {
+		return msg, nil
+	}
+
+	q := *msg
+	q.opts |= o_SLAVE_OK
+
+	// The slaveOk bit is enough for a mongos to read secondaryPreferred.
+	if self.replset != nil || (mode == ReadSecondaryPreferred && len(pref.Tags) == 0 && pref.MaxStaleness == 0) {
+		return &q, nil
+	}
+
+	var err os.Error
+	if q.query, err = wrapReadPreference(msg.query, pref); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+/* Adds $readPreference to query, wrapping it in $query unless it is
+already. */
+func wrapReadPreference(query BSON, pref *ReadPreference) (BSON, os.Error) {
+	var doc Doc
+	if obj, ok := query.(*_Object); ok && obj.Get("$query").Kind() != NullKind {
+		for _, k := range obj.keys {
+			doc = append(doc, DocElem{k, obj.value[k]})
+		}
+	} else {
+		doc = Doc{{"$query", query}}
+	}
+
+	return Marshal(append(doc, DocElem{"$readPreference", pref.document()}))
+}
+
+
+// === Member selection
+// ===
+
+/* Gets the pool of a member to read from following pref, discovering the
+set again if none matches. */
+func (self *ReplicaSet) selectPool(pref *ReadPreference) (*Pool, os.Error) {
+	if pref.mode() == ReadPrimary {
+		return self.primaryPool()
+	}
+
+	pool := self.selectMember(pref)
+	if pool == nil {
+		self.Refresh()
+		pool = self.selectMember(pref)
+	}
+	if pool == nil {
+		return nil, ErrNoMember
+	}
+	return pool, nil
+}
+
+/* Picks the pool of a member matching pref, or nil. */
+func (self *ReplicaSet) selectMember(pref *ReadPreference) *Pool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var secondaries []*member
+	for _, m := range self.members {
+		if m.State == MemberSecondary && m.pool != nil && self.fresh(m, pref.MaxStaleness) {
+			secondaries = append(secondaries, m)
+		}
+	}
+
+	var candidates []*member
+	switch pref.mode() {
+	case ReadPrimaryPreferred:
+		if self.primary != nil {
+			return self.primary.pool
+		}
+		candidates = matchTags(secondaries, pref.Tags)
+	case ReadSecondary:
+		candidates = matchTags(secondaries, pref.Tags)
+	case ReadSecondaryPreferred:
+		candidates = matchTags(secondaries, pref.Tags)
+		if len(candidates) == 0 && self.primary != nil {
+			return self.primary.pool
+		}
+	case ReadNearest:
+		if self.primary != nil {
+			secondaries = append(secondaries, self.primary)
+		}
+		candidates = matchTags(secondaries, pref.Tags)
+	}
+
+	if m := nearest(candidates); m != nil {
+		return m.pool
+	}
+	return nil
+}
+
+/* Reports whether the secondary m lags behind the primary by at most
+maxStaleness seconds, as estimated from the last writes of the members;
+any lag does if maxStaleness is zero. The caller must hold the mutex. */
+func (self *ReplicaSet) fresh(m *member, maxStaleness int64) bool {
+	if maxStaleness <= 0 {
+		return true
+	}
+
+	var staleness int64 // nanoseconds
+	if p := self.primary; p != nil {
+		staleness = (m.lastUpdate - m.lastWrite*1e9) - (p.lastUpdate - p.lastWrite*1e9) + self.interval
+	} else {
+		// Against the secondary that saw the latest write.
+		var latest int64
+		for _, s := range self.members {
+			if s.State == MemberSecondary && s.lastWrite > latest {
+				latest = s.lastWrite
+			}
+		}
+		staleness = (latest-m.lastWrite)*1e9 + self.interval
+	}
+	return staleness <= maxStaleness*1e9
+}
+
+/* Gets the members matching the first tag set that any of them matches.
+No tag sets match every member. */
+func matchTags(members []*member, tagSets []map[string]string) []*member {
+	if len(tagSets) == 0 {
+		return members
+	}
+
+	for _, tags := range tagSets {
+		var matched []*member
+		for _, m := range members {
+			if hasTags(m, tags) {
+				matched = append(matched, m)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+	return nil
+}
+
+func hasTags(m *member, tags map[string]string) bool {
+	for k, v := range tags {
+		if m.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+/* Picks at random one of the members whose round trip is within
+localThreshold of the fastest, to spread the reads. */
+func nearest(members []*member) *member {
+	if len(members) == 0 {
+		return nil
+	}
+
+	fastest := members[0].RTT
+	for _, m := range members {
+		if m.RTT < fastest {
+			fastest = m.RTT
+		}
+	}
+
+	var near []*member
+	for _, m := range members {
+		if m.RTT <= fastest+localThreshold {
+			near = append(near, m)
+		}
+	}
+	return near[rand.Intn(len(near))]
+}
+
+/* Gets the time of the last write seen by a member, in seconds since the
+epoch, from the lastWrite of its isMaster reply; zero if unknown. */
+func lastWriteDate(reply BSON) int64 {
+	date := reply.Get("lastWrite").Get("lastWriteDate")
+	if date.Kind() != DateKind || date.Date() == nil {
+		return 0
+	}
+	return date.Date().Seconds()
+}
@@ -0,0 +1,145 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+/* Runs a query following pref and gets the member of set that answered. */
+func readMember(coll *Collection, pref *ReadPreference, set []*fakeMember) (*fakeMember, os.Error) {
+	before := make([]int, len(set))
+	for i, m := range set {
+		before[i] = m.readCount()
+	}
+
+	coll.SetReadPreference(pref)
+	var doc BSON
+	if err := coll.Find(nil).One(&doc); err != ErrNotFound {
+		return nil, err
+	}
+
+	for i, m := range set {
+		if m.readCount() > before[i] {
+			return m, nil
+		}
+	}
+	return nil, os.NewError("no member answered")
+}
+
+func TestReadPreference(t *testing.T) {
+	set := newFakeSet(t, "rs", MemberPrimary, MemberSecondary, MemberSecondary)
+	a, b, c := set[0], set[1], set[2]
+	defer a.kill()
+	defer b.kill()
+	defer c.kill()
+
+	// c is in another data center, and ten minutes behind.
+	now := time.Seconds()
+	a.lastWrite, b.lastWrite, c.lastWrite = now, now, now-600
+	c.tags = map[string]string{"dc": "sf"}
+
+	conn, err := connectReplicaSet("rs", []string{a.addr}, DefaultPoolOptions, 0, plainDialer)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer conn.Disconnect()
+	coll := conn.GetDB("db").GetCollection("c")
+
+	tags := func(dcs ...string) []map[string]string {
+		sets := make([]map[string]string, len(dcs))
+		for i, dc := range dcs {
+			sets[i] = map[string]string{"dc": dc}
+		}
+		return sets
+	}
+
+	tests := []struct {
+		pref   *ReadPreference
+		member *fakeMember
+	}{
+		{nil, a},
+		{&ReadPreference{Mode: ReadPrimaryPreferred}, a},
+		{&ReadPreference{Mode: ReadSecondary, Tags: tags("sf")}, c},
+		{&ReadPreference{Mode: ReadSecondary, Tags: tags("la", "ny")}, b},
+		{&ReadPreference{Mode: ReadSecondaryPreferred, Tags: tags("la")}, a},
+		{&ReadPreference{Mode: ReadNearest, Tags: tags("sf")}, c},
+		{&ReadPreference{Mode: ReadSecondary, MaxStaleness: 90}, b},
+	}
+	for _, test := range tests {
+		m, err := readMember(coll, test.pref, set)
+		assertTrue(err == nil && m == test.member, fmt.Sprintf("read %v from %v, %v", test.pref, m, err), t)
+		if m != nil {
+			assertTrue(m.slaveOk == (test.pref != nil && test.pref.Mode != ReadPrimary), fmt.Sprintf("slaveOk with %v", test.pref), t)
+		}
+	}
+
+	m, err := readMember(coll, &ReadPreference{Mode: ReadSecondary}, set)
+	assertTrue(err == nil && (m == b || m == c), fmt.Sprintf("read from a secondary: %v", err), t)
+
+	_, err = readMember(coll, &ReadPreference{Mode: ReadSecondary, Tags: tags("sf"), MaxStaleness: 90}, set)
+	assertTrue(err == ErrNoMember, fmt.Sprintf("read from a stale secondary: %v", err), t)
+
+	// Counts follow the read preference; other commands go to the primary.
+	all, _ := Marshal(Doc{})
+	count, _ := Marshal(Doc{{"count", "c"}})
+	reads, primaryReads := c.readCount(), a.readCount()
+	coll.SetReadPreference(&ReadPreference{Mode: ReadSecondary, Tags: tags("sf")})
+	_, err = coll.Count(all)
+	assertTrue(err == nil && c.readCount() == reads+1 && c.slaveOk, fmt.Sprintf("count on a secondary: %v", err), t)
+	_, err = coll.Find(nil).Count()
+	assertTrue(err == nil && c.readCount() == reads+2, fmt.Sprintf("query count on a secondary: %v", err), t)
+	db := conn.GetDB("db")
+	db.SetReadPreference(&ReadPreference{Mode: ReadSecondary})
+	_, err = db.Command(count)
+	assertTrue(err == nil && a.readCount() == primaryReads+1 && !a.slaveOk, fmt.Sprintf("command on the primary: %v", err), t)
+
+	// Without a primary, the secondaries are still read from, and staleness
+	// is measured against the most recent of them.
+	a.kill()
+	conn.ReplicaSet().Refresh()
+	_, err = readMember(coll, nil, set)
+	assertTrue(err == ErrNoPrimary, fmt.Sprintf("read from a dead primary: %v", err), t)
+	m, err = readMember(coll, &ReadPreference{Mode: ReadPrimaryPreferred, MaxStaleness: 90}, set)
+	assertTrue(err == nil && m == b, fmt.Sprintf("primaryPreferred without a primary: %v, %v", m, err), t)
+	_, err = readMember(coll, &ReadPreference{Mode: ReadNearest, Tags: tags("sf"), MaxStaleness: 90}, set)
+	assertTrue(err == ErrNoMember, fmt.Sprintf("read from a stale secondary: %v", err), t)
+}
+
+func TestReadPreferenceMongos(t *testing.T) {
+	conn := &Connection{}
+	filter, _ := Marshal(Doc{{"a", 1}})
+	msg := &opQuery{query: filter}
+
+	q, err := conn.readQuery(msg, PrimaryOnly)
+	assertTrue(err == nil && q == msg && q.opts&o_SLAVE_OK == 0, "primary query changed", t)
+
+	// The slaveOk bit is enough for secondaryPreferred.
+	q, err = conn.readQuery(msg, &ReadPreference{Mode: ReadSecondaryPreferred})
+	assertTrue(err == nil && q.opts&o_SLAVE_OK != 0 && Equal(q.query, filter), "secondaryPreferred query", t)
+	assertTrue(msg.opts&o_SLAVE_OK == 0, "original query changed", t)
+
+	pref := &ReadPreference{Mode: ReadSecondary, Tags: []map[string]string{{"dc": "ny"}}, MaxStaleness: 120}
+	q, err = conn.readQuery(msg, pref)
+	expected, _ := Marshal(Doc{
+		{"$query", Doc{{"a", 1}}},
+		{"$readPreference", Doc{
+			{"mode", "secondary"},
+			{"tags", []Doc{{{"dc", "ny"}}}},
+			{"maxStalenessSeconds", int64(120)},
+		}},
+	})
+	assertTrue(err == nil && q.opts&o_SLAVE_OK != 0 && Equal(q.query, expected), fmt.Sprintf("wrapped query %v, %v", q.query, err), t)
+
+	// Modifiers stay along with $readPreference.
+	sorted, _ := Marshal(Doc{{"$query", Doc{{"a", 1}}}, {"$orderby", Doc{{"b", 1}}}})
+	q, err = conn.readQuery(&opQuery{query: sorted}, pref)
+	assertTrue(err == nil, fmt.Sprintf("wrap sorted query: %v", err), t)
+	assertTrue(toInt(q.query.Get("$query").Get("a")) == 1 && toInt(q.query.Get("$orderby").Get("b")) == 1, "modifiers lost", t)
+	assertTrue(q.query.Get("$readPreference").Get("mode").String() == ReadSecondary, "no $readPreference", t)
+}
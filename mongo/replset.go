@@ -0,0 +1,471 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* Replica sets
+
+http://www.mongodb.org/display/DOCS/Replica+Sets
+http://www.mongodb.org/display/DOCS/Connecting+Drivers+to+Replica+Sets
+
+The members are found by running isMaster on the seeds, then on the hosts
+they list. Writes go to the primary; when it fails or steps down, the set
+is discovered again.
+*/
+
+package mongo
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+var ErrNoPrimary = os.NewError("no primary in the replica set")
+
+// Roles of a member.
+const (
+	MemberUnknown = iota // unreachable, or not checked yet
+	MemberPrimary
+	MemberSecondary
+	MemberOther // arbiter, recovering, ...
+)
+
+// Nanoseconds between two checks of the members by default.
+const DefaultHeartbeatInterval = 10e9
+
+/* A member of a replica set, as last seen. */
+type MemberInfo struct {
+	Addr  string // "host:port", as listed by the set
+	State int    // one of the Member* roles
+	Tags  map[string]string
+	RTT   int64    // nanoseconds taken by the last isMaster
+	Err   os.Error // why the last check failed, if it did
+}
+
+func (self *MemberInfo) String() string {
+	state := [...]string{"unknown", "primary", "secondary", "other"}[self.State]
+	if self.Err != nil {
+		return fmt.Sprintf("%s (%s: %s)", self.Addr, state, self.Err)
+	}
+	return fmt.Sprintf("%s (%s)", self.Addr, state)
+}
+
+type member struct {
+	MemberInfo
+	pool *Pool // nil while unreachable
+
+	lastWrite  int64 // seconds since the epoch of the last write it saw; zero if unknown
+	lastUpdate int64 // nanoseconds since the epoch of the last check
+}
+
+/* The members of a replica set, with a pool of sockets for each, as watched
+by a monitor goroutine. It is safe to use from many goroutines. */
+type ReplicaSet struct {
+	Name string // of the set; empty accepts any set
+
+	seeds     []string
+	options   PoolOptions
+	newDialer func(host string) (*dialer, os.Error)
+	interval  int64
+
+	mutex       sync.Mutex
+	members     map[string]*member // by address
+	primary     *member
+	credentials []*credential
+	watchers    []chan []MemberInfo
+	closed      bool
+
+	refreshMutex sync.Mutex // one discovery at a time
+	done         chan bool  // stops the monitor
+}
+
+/* Connects to the replica set name, found from seeds, a list of
+"host:port". An empty name accepts any set. */
+func ConnectReplicaSet(name string, seeds []string) (*Connection, os.Error) {
+	return connectReplicaSet(name, seeds, DefaultPoolOptions, DefaultHeartbeatInterval, plainDialer)
+}
+
+func plainDialer(host string) (*dialer, os.Error) {
+	return &dialer{}, nil
+}
+
+func connectReplicaSet(name string, seeds []string, options PoolOptions, interval int64, newDialer func(string) (*dialer, os.Error)) (*Connection, os.Error) {
+	if len(seeds) == 0 {
+		return nil, os.NewError("no hosts to connect to")
+	}
+
+	self := &ReplicaSet{
+		Name:      name,
+		seeds:     seeds,
+		options:   options,
+		newDialer: newDialer,
+		interval:  interval,
+		members:   make(map[string]*member),
+		done:      make(chan bool),
+	}
+
+	self.Refresh()
+	pool, err := self.primaryPool()
+	if err != nil {
+		self.close()
+		return nil, err
+	}
+
+	if interval > 0 {
+		go self.monitor()
+	}
+	return &Connection{Addr: pool.Addr, replset: self, cursors: newCursorRegistry()}, nil
+}
+
+/* Gets the replica set of the connection, or nil if it is connected to a
+single server. */
+func (self *Connection) ReplicaSet() *ReplicaSet {
+	return self.replset
+}
+
+/* Lists the members, sorted by address. */
+func (self *ReplicaSet) Members() []MemberInfo {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.memberList()
+}
+
+func (self *ReplicaSet) memberList() []MemberInfo {
+	addrs := make([]string, 0, len(self.members))
+	for addr := range self.members {
+		addrs = append(addrs, addr)
+	}
+	sort.SortStrings(addrs)
+
+	infos := make([]MemberInfo, len(addrs))
+	for i, addr := range addrs {
+		infos[i] = self.members[addr].MemberInfo
+	}
+	return infos
+}
+
+/* Gets a channel that receives the members every time their roles or the
+membership change. Only the latest list is kept for a slow reader. */
+func (self *ReplicaSet) Watch() <-chan []MemberInfo {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	ch := make(chan []MemberInfo, 1)
+	self.watchers = append(self.watchers, ch)
+	return ch
+}
+
+/* Sends the members to the watchers. The caller must hold the mutex. */
+func (self *ReplicaSet) notify() {
+	infos := self.memberList()
+	for _, ch := range self.watchers {
+		// Replace the list nobody read yet.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- infos
+	}
+}
+
+/* Checks the members now, looking for new ones and for the primary. The
+monitor goroutine does it every heartbeat interval. */
+func (self *ReplicaSet) Refresh() {
+	self.refreshMutex.Lock()
+	defer self.refreshMutex.Unlock()
+
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return
+	}
+	queue := append([]string{}, self.seeds...)
+	for addr := range self.members {
+		queue = append(queue, addr)
+	}
+	self.mutex.Unlock()
+
+	// Breadth-first, from the seeds and the known members to the hosts
+	// they list.
+	seen := make(map[string]bool)
+	listed := make(map[string]bool)
+	checked := make(map[string]*member)
+	for len(queue) > 0 {
+		addr := queue[0]
+		queue = queue[1:]
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		m, hosts := self.check(addr)
+		checked[addr] = m
+		for _, h := range hosts {
+			listed[h] = true
+			queue = append(queue, h)
+		}
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		for _, m := range checked {
+			if m.pool != nil {
+				m.pool.Close()
+			}
+		}
+		return
+	}
+
+	// The set is what its members list. If none answered, the known
+	// members are kept, to be tried again. A seed that isn't listed, such
+	// as an alias of a member, is dropped, even if it is the primary.
+	members := make(map[string]*member)
+	var primary *member
+	for addr, m := range checked {
+		_, known := self.members[addr]
+		if listed[addr] || (len(listed) == 0 && known) {
+			members[addr] = m
+			if m.State == MemberPrimary && primary == nil {
+				primary = m
+			}
+		} else if m.pool != nil {
+			m.pool.Close()
+		}
+	}
+
+	changed := len(members) != len(self.members)
+	for addr, m := range members {
+		old, ok := self.members[addr]
+		if !ok || old.State != m.State {
+			changed = true
+		}
+	}
+	self.members, self.primary = members, primary
+	if changed {
+		self.notify()
+	}
+}
+
+/* Runs isMaster on the member at addr, returning what it is and the hosts
+it lists. */
+func (self *ReplicaSet) check(addr string) (*member, []string) {
+	m := &member{MemberInfo: MemberInfo{Addr: addr}}
+	self.mutex.Lock()
+	if old, ok := self.members[addr]; ok {
+		m.pool, m.Tags = old.pool, old.Tags
+	}
+	self.mutex.Unlock()
+
+	if m.pool == nil {
+		if m.pool, m.Err = self.dial(addr); m.Err != nil {
+			return m, nil
+		}
+	}
+
+	start := time.Nanoseconds()
+	reply, err := isMaster(m.pool)
+	m.lastUpdate = time.Nanoseconds()
+	m.RTT = m.lastUpdate - start
+	if err != nil {
+		// The next check dials again.
+		m.pool.Close()
+		m.pool, m.Err = nil, err
+		return m, nil
+	}
+
+	if setName := reply.Get("setName"); setName.Kind() != StringKind || (self.Name != "" && setName.String() != self.Name) {
+		m.pool.Close()
+		m.pool, m.Err = nil, os.NewError(fmt.Sprintf("not a member of replica set %q", self.Name))
+		return m, nil
+	}
+
+	switch {
+	case reply.Get("ismaster").Bool():
+		m.State = MemberPrimary
+	case reply.Get("secondary").Bool():
+		m.State = MemberSecondary
+	default:
+		m.State = MemberOther
+	}
+
+	m.lastWrite = lastWriteDate(reply)
+
+	if tags := reply.Get("tags"); tags.Kind() == ObjectKind {
+		m.Tags = make(map[string]string)
+		for _, k := range tags.(*_Object).keys {
+			m.Tags[k] = tags.Get(k).String()
+		}
+	}
+
+	var hosts []string
+	for _, field := range []string{"hosts", "passives", "arbiters"} {
+		list := reply.Get(field)
+		for i := 0; i < list.Len(); i++ {
+			hosts = append(hosts, list.Elem(i).String())
+		}
+	}
+	return m, hosts
+}
+
+/* Opens a pool to a member, logged in with the credentials of the set. */
+func (self *ReplicaSet) dial(addr string) (*Pool, os.Error) {
+	tcpAddr, err := net.ResolveTCPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := self.newDialer(hostName(addr))
+	if err != nil {
+		return nil, err
+	}
+	pool, err := newPool(tcpAddr, self.options, d)
+	if err != nil {
+		return nil, err
+	}
+
+	self.mutex.Lock()
+	pool.credentials = append([]*credential{}, self.credentials...)
+	self.mutex.Unlock()
+	return pool, nil
+}
+
+/* Runs isMaster on a socket of pool, without logging it in. */
+func isMaster(pool *Pool) (BSON, os.Error) {
+	sock, err := pool.get(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.checkin(sock)
+
+	return sock.command("admin", Doc{{"isMaster", 1}})
+}
+
+/* Gets the pool of the primary, discovering the set again if there is
+none. */
+func (self *ReplicaSet) primaryPool() (*Pool, os.Error) {
+	self.mutex.Lock()
+	primary := self.primary
+	self.mutex.Unlock()
+
+	if primary == nil {
+		self.Refresh()
+		self.mutex.Lock()
+		primary = self.primary
+		self.mutex.Unlock()
+	}
+
+	if primary == nil {
+		return nil, ErrNoPrimary
+	}
+	return primary.pool, nil
+}
+
+/* Marks the member of pool as unknown, after a network error or a "not
+master" reply, so that the next operation discovers the set again. */
+func (self *ReplicaSet) failed(pool *Pool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return
+	}
+	for _, m := range self.members {
+		if m.pool == pool && m.State != MemberUnknown {
+			m.State = MemberUnknown
+			if m == self.primary {
+				self.primary = nil
+			}
+			self.notify()
+		}
+	}
+}
+
+/* Keeps cred, and has the sockets of every member log in with it. */
+func (self *ReplicaSet) addCredential(cred *credential) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	replaced := false
+	for i, c := range self.credentials {
+		if c.source == cred.source {
+			self.credentials[i], replaced = cred, true
+		}
+	}
+	if !replaced {
+		self.credentials = append(self.credentials, cred)
+	}
+
+	for _, m := range self.members {
+		if m.pool != nil {
+			m.pool.addCredential(cred)
+		}
+	}
+}
+
+func (self *ReplicaSet) monitor() {
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			self.Refresh()
+		}
+	}
+}
+
+/* Stops the monitor and closes the pools of the members. */
+func (self *ReplicaSet) close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return
+	}
+	self.closed = true
+	close(self.done)
+
+	for _, m := range self.members {
+		if m.pool != nil {
+			m.pool.Close()
+		}
+	}
+	for _, ch := range self.watchers {
+		close(ch)
+	}
+}
+
+/* Reports whether err means that the server is not, or no longer, the
+primary. */
+func isNotMaster(err os.Error) bool {
+	code, msg := 0, ""
+	switch e := err.(type) {
+	case *QueryError:
+		code, msg = e.Code, e.Message
+	case *CommandError:
+		code, msg = e.Code, e.Message
+	case *WriteError:
+		code, msg = e.Code, e.Message
+	default:
+		return false
+	}
+
+	switch code {
+	case 10107, 13435, 13436, 10058, 189, 91, 11600, 11602:
+		// NotMaster, NotMasterNoSlaveOk, NotMasterOrSecondary, the legacy
+		// "not master" of getLastError, PrimarySteppedDown,
+		// ShutdownInProgress, InterruptedAtShutdown and
+		// InterruptedDueToReplStateChange.
+		return true
+	}
+	return strings.Contains(msg, "not master")
+}
@@ -0,0 +1,333 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* An in-process member of a replica set, that answers isMaster and counts
+the inserts it takes as primary and the queries it answers, with no
+documents, counts included. Queries on collections named "stall" get no
+reply. */
+type fakeMember struct {
+	setName string
+	l       net.Listener
+	addr    string
+
+	mutex     sync.Mutex
+	state     int
+	hosts     []string
+	tags      map[string]string
+	lastWrite int64 // seconds since the epoch; not reported if zero
+	inserts   int
+	reads     int
+	slaveOk   bool // of the last query
+	conns     []net.Conn
+}
+
+func newFakeMember(t *testing.T, setName string, state int) *fakeMember {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	self := &fakeMember{setName: setName, l: l, addr: l.Addr().String(), state: state, tags: map[string]string{"dc": "ny"}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			self.mutex.Lock()
+			self.conns = append(self.conns, conn)
+			self.mutex.Unlock()
+			go self.serve(conn)
+		}
+	}()
+	return self
+}
+
+/* Builds a replica set of members in the given states. */
+func newFakeSet(t *testing.T, setName string, states ...int) []*fakeMember {
+	members := make([]*fakeMember, len(states))
+	hosts := make([]string, len(states))
+	for i, state := range states {
+		members[i] = newFakeMember(t, setName, state)
+		hosts[i] = members[i].addr
+	}
+	for _, m := range members {
+		m.hosts = hosts
+	}
+	return members
+}
+
+func (self *fakeMember) setState(state int) {
+	self.mutex.Lock()
+	self.state = state
+	self.mutex.Unlock()
+}
+
+func (self *fakeMember) insertCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.inserts
+}
+
+func (self *fakeMember) readCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.reads
+}
+
+/* Stops the server, hanging up on its clients. */
+func (self *fakeMember) kill() {
+	self.l.Close()
+	self.mutex.Lock()
+	for _, conn := range self.conns {
+		conn.Close()
+	}
+	self.mutex.Unlock()
+}
+
+func (self *fakeMember) serve(conn net.Conn) {
+	defer conn.Close()
+
+	rejected := false // an insert came in while not primary
+	for {
+		reqID, opCode, body, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+
+		self.mutex.Lock()
+		primary := self.state == MemberPrimary
+		if opCode == _OP_INSERT {
+			if primary {
+				self.inserts++
+			} else {
+				rejected = true
+			}
+			self.mutex.Unlock()
+			continue
+		}
+		if ns := body[4 : 4+bytes.IndexByte(body[4:], 0)]; !strings.HasSuffix(string(ns), ".$cmd") {
+			if strings.HasSuffix(string(ns), ".stall") {
+				self.mutex.Unlock()
+				continue
+			}
+			self.reads++
+			self.slaveOk = int32(pack.Uint32(body[0:4]))&o_SLAVE_OK != 0
+			self.mutex.Unlock()
+			conn.Write(framed(replyBytes(reqID, 0, 0)))
+			continue
+		}
+
+		cmd, err := queryDocument(body)
+		if err != nil {
+			self.mutex.Unlock()
+			return
+		}
+		reply := Doc{{"ok", 1}}
+		switch cmd.(*_Object).keys[0] {
+		case "isMaster":
+			reply = Doc{
+				{"ismaster", primary},
+				{"secondary", self.state == MemberSecondary},
+				{"setName", self.setName},
+				{"hosts", self.hosts},
+				{"tags", self.tags},
+				{"ok", 1},
+			}
+			if self.lastWrite != 0 {
+				reply = append(reply, DocElem{"lastWrite", Doc{{"lastWriteDate", time.SecondsToUTC(self.lastWrite)}}})
+			}
+		case "count":
+			self.reads++
+			self.slaveOk = int32(pack.Uint32(body[0:4]))&o_SLAVE_OK != 0
+			reply = Doc{{"n", 0}, {"ok", 1}}
+		case "getlasterror":
+			if rejected {
+				reply = Doc{{"err", "not master"}, {"code", 10058}, {"ok", 1}}
+				rejected = false
+			} else {
+				reply = Doc{{"err", nil}, {"n", 0}, {"ok", 1}}
+			}
+		}
+		self.mutex.Unlock()
+
+		doc, _ := Marshal(reply)
+		conn.Write(framed(replyBytes(reqID, 0, 0, doc)))
+	}
+}
+
+func primaryOf(rs *ReplicaSet) string {
+	for _, m := range rs.Members() {
+		if m.State == MemberPrimary {
+			return m.Addr
+		}
+	}
+	return ""
+}
+
+func TestReplicaSetDiscovery(t *testing.T) {
+	set := newFakeSet(t, "rs", MemberPrimary, MemberSecondary, MemberSecondary)
+	a, b, c := set[0], set[1], set[2]
+	defer a.kill()
+	defer b.kill()
+	defer c.kill()
+
+	// Seeded with a secondary only.
+	conn, err := connectReplicaSet("rs", []string{b.addr}, DefaultPoolOptions, 0, plainDialer)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer conn.Disconnect()
+
+	rs := conn.ReplicaSet()
+	members := rs.Members()
+	assertTrue(len(members) == 3, fmt.Sprintf("discovered %v", members), t)
+	assertTrue(primaryOf(rs) == a.addr && conn.Addr.String() == a.addr, "primary not found", t)
+	assertTrue(members[0].Tags["dc"] == "ny", "member tags", t)
+
+	coll := conn.GetDB("db").GetCollection("c")
+	doc, _ := Marshal(Doc{{"a", 1}})
+	_, err = coll.Insert(doc)
+	assertTrue(err == nil && a.insertCount() == 1, fmt.Sprintf("insert not on the primary: %v", err), t)
+
+	// The primary steps down: the write fails, and the next finds the new
+	// primary.
+	a.setState(MemberSecondary)
+	b.setState(MemberPrimary)
+	_, err = coll.Insert(doc)
+	assertTrue(err != nil && isNotMaster(err), fmt.Sprintf("insert on a former primary gave %v", err), t)
+	_, err = coll.Insert(doc)
+	assertTrue(err == nil && b.insertCount() == 1, fmt.Sprintf("insert after a step down: %v", err), t)
+
+	// The primary dies.
+	c.setState(MemberPrimary)
+	b.kill()
+	_, err = coll.Insert(doc)
+	assertTrue(err != nil, "insert on a dead primary", t)
+	_, err = coll.Insert(doc)
+	assertTrue(err == nil && c.insertCount() == 1, fmt.Sprintf("insert after the primary died: %v", err), t)
+
+	for _, m := range rs.Members() {
+		if m.Addr == b.addr {
+			assertTrue(m.State == MemberUnknown && m.Err != nil, "dead member: "+m.String(), t)
+		}
+	}
+
+	// A fresh connection discovers the set again.
+	conn2, err := conn.Reconnect()
+	assertTrue(err == nil && conn2.Addr.String() == c.addr, fmt.Sprintf("reconnect: %v", err), t)
+	if err == nil {
+		conn2.Disconnect()
+	}
+
+	_, err = connectReplicaSet("other", []string{a.addr}, DefaultPoolOptions, 0, plainDialer)
+	assertTrue(err == ErrNoPrimary, fmt.Sprintf("connected to the wrong set: %v", err), t)
+}
+
+func TestReplicaSetAliasSeed(t *testing.T) {
+	set := newFakeSet(t, "rs", MemberPrimary, MemberSecondary)
+	a, b := set[0], set[1]
+	defer a.kill()
+	defer b.kill()
+
+	// The set lists 127.0.0.1, not the name it is seeded with.
+	alias := "localhost" + a.addr[strings.LastIndex(a.addr, ":"):]
+	conn, err := connectReplicaSet("rs", []string{alias}, DefaultPoolOptions, 0, plainDialer)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer conn.Disconnect()
+
+	rs := conn.ReplicaSet()
+	assertTrue(primaryOf(rs) == a.addr && len(rs.Members()) == 2, fmt.Sprintf("members %v", rs.Members()), t)
+
+	doc, _ := Marshal(Doc{{"a", 1}})
+	for i := 0; i < 2; i++ {
+		_, err = conn.GetDB("db").GetCollection("c").Insert(doc)
+		assertTrue(err == nil, fmt.Sprintf("insert through an alias seed: %v", err), t)
+	}
+	assertTrue(a.insertCount() == 2, "inserts not on the primary", t)
+}
+
+func TestReplicaSetContext(t *testing.T) {
+	set := newFakeSet(t, "rs", MemberPrimary, MemberSecondary)
+	a, b := set[0], set[1]
+	defer a.kill()
+	defer b.kill()
+
+	conn, err := connectReplicaSet("rs", []string{a.addr}, DefaultPoolOptions, 0, plainDialer)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer conn.Disconnect()
+	rs := conn.ReplicaSet()
+	db := conn.GetDB("db")
+	doc, _ := Marshal(Doc{{"a", 1}})
+
+	// Canceled before the checkout, then in flight: the primary is kept.
+	ctx, cancel := WithCancel(nil)
+	cancel()
+	_, err = db.GetCollection("c").InsertContext(ctx, doc)
+	assertTrue(err == ErrCanceled, fmt.Sprintf("insert with a canceled context: %v", err), t)
+	assertTrue(primaryOf(rs) == a.addr, "primary dropped after a cancel", t)
+
+	ctx, cancel = WithTimeout(nil, 50e6)
+	defer cancel()
+	_, err = db.GetCollection("stall").FindOneContext(ctx, doc)
+	assertTrue(err == ErrDeadlineExceeded, fmt.Sprintf("query past its deadline: %v", err), t)
+	assertTrue(primaryOf(rs) == a.addr, "primary dropped after a deadline", t)
+
+	_, err = db.GetCollection("c").Insert(doc)
+	assertTrue(err == nil && a.insertCount() == 1, fmt.Sprintf("insert after a deadline: %v", err), t)
+}
+
+func TestReplicaSetMonitor(t *testing.T) {
+	set := newFakeSet(t, "rs", MemberPrimary, MemberSecondary)
+	a, b := set[0], set[1]
+	defer a.kill()
+	defer b.kill()
+
+	conn, err := connectReplicaSet("rs", []string{a.addr}, DefaultPoolOptions, 20e6, plainDialer)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	changes := conn.ReplicaSet().Watch()
+	a.setState(MemberSecondary)
+	b.setState(MemberPrimary)
+
+	timeout := time.After(5e9)
+	found := false
+	for !found {
+		select {
+		case members := <-changes:
+			for _, m := range members {
+				found = found || (m.Addr == b.addr && m.State == MemberPrimary)
+			}
+		case <-timeout:
+			t.Fatalf("the monitor didn't see the new primary")
+		}
+	}
+
+	conn.Disconnect()
+	for open := true; open; {
+		select {
+		case _, open = <-changes:
+		case <-timeout:
+			t.Fatalf("watch channel not closed on Disconnect")
+		}
+	}
+}
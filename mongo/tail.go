@@ -0,0 +1,144 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* Tailable cursors
+
+http://www.mongodb.org/display/DOCS/Tailable+Cursors
+*/
+
+package mongo
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+
+var (
+	ErrCursorDead = os.NewError("tailable cursor is dead")
+	ErrTimeout    = os.NewError("timed out waiting for a document")
+)
+
+/* Follows a capped collection, such as the oplog, as documents are
+inserted:
+
+	tail := coll.Find(nil).Tail(5e9)
+	for {
+		err := tail.Next(&entry)
+		switch err {
+		case ErrTimeout:
+			continue
+		case ErrCursorDead:
+			time.Sleep(1e9) // wait for the first documents
+			continue
+		}
+		...
+	}
+*/
+type TailIterator struct {
+	// Nanoseconds to wait before asking again for new documents.
+	PollInterval int64
+	// Element that grows with each insert, from whose last value a dead
+	// cursor resumes: "ts" for the oplog, "_id" otherwise.
+	ResumeField string
+
+	query   *Query
+	timeout int64
+	cursor  *Cursor
+	last    BSON // value of ResumeField in the last document
+}
+
+/* Gets an iterator following the results of the query. Next waits for a
+new document for timeout nanoseconds at most; forever if timeout is
+negative. */
+func (self *Query) Tail(timeout int64) *TailIterator {
+	self.Tailable().AwaitData()
+
+	field := "_id"
+	if strings.HasPrefix(self.collection.name, "oplog.") {
+		field = "ts"
+	}
+	return &TailIterator{PollInterval: 1e8, ResumeField: field, query: self, timeout: timeout}
+}
+
+/* Decodes the next document into result, as Query.One does. Returns
+ErrTimeout if no document came in time, and ErrCursorDead if the cursor
+died and couldn't be resumed, as when the collection is empty or the last
+document seen was overwritten. */
+func (self *TailIterator) Next(result interface{}) os.Error {
+	deadline := time.Nanoseconds() + self.timeout
+	resumed := false
+
+	for {
+		if self.cursor == nil {
+			cursor, err := self.resume()
+			if err != nil {
+				return err
+			}
+			self.cursor, resumed = cursor, true
+		}
+
+		if doc, err := self.cursor.GetNext(); err == nil {
+			self.last = doc.Get(self.ResumeField)
+			return decode(doc, result)
+		}
+
+		if err := self.cursor.Err(); err != nil && err != ErrCursorNotFound {
+			self.cursor = nil
+			return err
+		}
+		if !self.cursor.Alive() {
+			self.cursor = nil
+			if resumed {
+				return ErrCursorDead
+			}
+			continue
+		}
+
+		wait := self.PollInterval
+		if self.timeout >= 0 {
+			left := deadline - time.Nanoseconds()
+			if left <= 0 {
+				return ErrTimeout
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		time.Sleep(wait)
+	}
+
+	panic("unreachable")
+}
+
+/* Closes the cursor. Next can still be called; it resumes after the last
+document seen. */
+func (self *TailIterator) Close() os.Error {
+	if self.cursor == nil {
+		return nil
+	}
+	err := self.cursor.Close()
+	self.cursor = nil
+	return err
+}
+
+/* Runs the query again, for the documents after the last one seen. */
+func (self *TailIterator) resume() (*Cursor, os.Error) {
+	q := *self.query
+	if self.last != nil && self.last.Kind() != NullKind {
+		filter, err := q.marshalFilter()
+		if err != nil {
+			return nil, err
+		}
+		after := Doc{{self.ResumeField, Doc{{"$gt", self.last}}}}
+		q.filter = Doc{{"$and", []interface{}{filter, after}}}
+	}
+
+	cursor := q.Iter()
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
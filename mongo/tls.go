@@ -0,0 +1,172 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* TLS
+
+http://www.mongodb.org/display/DOCS/SSL
+
+With a client certificate, the MONGODB-X509 mechanism logs in as the user
+named after the certificate subject, in the $external database.
+*/
+
+package mongo
+
+import (
+	"asn1"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+
+/* How sockets are secured with TLS. */
+type TLSOptions struct {
+	// PEM file of the certificate authorities trusted to sign the server
+	// certificate. The system's if empty.
+	CAFile string
+
+	// PEM file of the client certificate, with its key unless KeyFile is
+	// set.
+	CertFile string
+	KeyFile  string
+
+	// Name checked against the server certificate; the host name if empty.
+	ServerName string
+
+	// Accepts any server certificate. For development only: anybody in the
+	// middle can read and change the traffic.
+	InsecureSkipVerify bool
+}
+
+/* Creates a new connection, secured following tlsOptions, whose sockets are
+pooled following options. Unless ServerName is set, the server certificate
+must be for the IP address of addr. */
+func ConnectByAddrTLS(addr *net.TCPAddr, options PoolOptions, tlsOptions *TLSOptions) (*Connection, os.Error) {
+	config, err := tlsOptions.config(addr.IP.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return connectByAddr(addr, options, &dialer{tls: config})
+}
+
+/* Builds the configuration of the sockets to host. */
+func (self *TLSOptions) config(host string) (*tls.Config, os.Error) {
+	config := &tls.Config{ServerName: self.ServerName, InsecureSkipVerify: self.InsecureSkipVerify}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	if self.CAFile != "" {
+		pem, err := ioutil.ReadFile(self.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, os.NewError("no certificates in " + self.CAFile)
+		}
+	}
+
+	if self.CertFile != "" {
+		keyFile := self.KeyFile
+		if keyFile == "" {
+			keyFile = self.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(self.CertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+/* Gets the subject of the client certificate, as the name of its user. */
+func (self *dialer) clientSubject() (string, os.Error) {
+	if self.tls == nil || len(self.tls.Certificates) == 0 {
+		return "", os.NewError("no client certificate")
+	}
+
+	cert, err := x509.ParseCertificate(self.tls.Certificates[0].Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return x509Subject(cert)
+}
+
+
+// === X.509 subject
+// ===
+
+type rdnAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value interface{}
+}
+
+// The asn1 package takes slices of types named "...SET" as SETs.
+type rdnSET []rdnAttribute
+
+// Short names of the attribute types, by object identifier.
+var rdnNames = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "STREET",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+}
+
+/* Formats the subject of cert following RFC 2253, as the server does:
+"CN=client,OU=drivers,O=gomongo,C=US". The order of the certificate is kept,
+which the parsed x509.Name loses. */
+func x509Subject(cert *x509.Certificate) (string, os.Error) {
+	var rdns []rdnSET
+	if _, err := asn1.Unmarshal(cert.RawSubject, &rdns); err != nil {
+		return "", err
+	}
+
+	// The most specific attribute comes first.
+	parts := make([]string, len(rdns))
+	for i, rdn := range rdns {
+		attrs := make([]string, len(rdn))
+		for j, attr := range rdn {
+			oid := make([]string, len(attr.Type))
+			for k, n := range attr.Type {
+				oid[k] = fmt.Sprint(n)
+			}
+			name, ok := rdnNames[strings.Join(oid, ".")]
+			if !ok {
+				name = strings.Join(oid, ".")
+			}
+			attrs[j] = name + "=" + escapeDN(fmt.Sprint(attr.Value))
+		}
+		parts[len(rdns)-1-i] = strings.Join(attrs, "+")
+	}
+	return strings.Join(parts, ","), nil
+}
+
+/* Escapes a value of a distinguished name. */
+func escapeDN(s string) string {
+	var buf bytes.Buffer
+	for i, c := range s {
+		switch {
+		case strings.IndexRune(",+\"\\<>;", c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(s)-1):
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
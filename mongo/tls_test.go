@@ -0,0 +1,197 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"big"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const clientSubject = "CN=client,OU=drivers,O=gomongo,C=US"
+
+/* Creates a certificate for name signed by parent, or self-signed if parent
+is nil. */
+func newCert(t *testing.T, serial int64, name x509.Name, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      name,
+		NotBefore:    time.SecondsToUTC(time.Seconds() - 3600),
+		NotAfter:     time.SecondsToUTC(time.Seconds() + 3600),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.DNSNames = []string{name.CommonName}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, file string, cert *x509.Certificate, key *rsa.PrivateKey) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if key != nil {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("write %s: %v", file, err)
+	}
+}
+
+func TestX509Subject(t *testing.T) {
+	ca, caKey := newCert(t, 1, x509.Name{CommonName: "ca"}, nil, nil)
+	cert, _ := newCert(t, 2, x509.Name{
+		CommonName:         "client",
+		OrganizationalUnit: []string{"drivers"},
+		Organization:       []string{"gomongo"},
+		Country:            []string{"US"},
+	}, ca, caKey)
+
+	subject, err := x509Subject(cert)
+	assertTrue(err == nil && subject == clientSubject, fmt.Sprintf("subject %q, %v", subject, err), t)
+
+	assertTrue(escapeDN(`a,b+c"d\e<f>g;h`) == `a\,b\+c\"d\\e\<f\>g\;h`, "special characters", t)
+	assertTrue(escapeDN("#a b ") == `\#a b\ `, "leading '#' and trailing space", t)
+}
+
+func TestTLSConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomongo")
+	if err != nil {
+		t.Fatalf("temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCert(t, 1, x509.Name{CommonName: "ca"}, nil, nil)
+	server, serverKey := newCert(t, 2, x509.Name{CommonName: "localhost"}, ca, caKey)
+	client, clientKey := newCert(t, 3, x509.Name{
+		CommonName:         "client",
+		OrganizationalUnit: []string{"drivers"},
+		Organization:       []string{"gomongo"},
+		Country:            []string{"US"},
+	}, ca, caKey)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	clientFile := filepath.Join(dir, "client.pem")
+	writePEM(t, caFile, ca, nil)
+	writePEM(t, clientFile, client, clientKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server := &fakeAuthServer{user: clientSubject, wireVersion: 6}
+			go server.serve(conn)
+		}
+	}()
+
+	connect := func(tlsOptions TLSOptions) (*Connection, os.Error) {
+		return ConnectWithOptions(&ConnectOptions{
+			Hosts:         []string{l.Addr().String()},
+			AuthMechanism: AuthMongoX509,
+			W:             1,
+			SSL:           true,
+			TLS:           tlsOptions,
+			Pool:          DefaultPoolOptions,
+		})
+	}
+
+	conn, err := connect(TLSOptions{CAFile: caFile, CertFile: clientFile, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	ping, _ := Marshal(Doc{{"ping", 1}})
+	_, err = conn.GetDB("db").Command(ping)
+	assertTrue(err == nil, fmt.Sprintf("command after X.509 login: %v", err), t)
+	conn.Disconnect()
+
+	conn, err = connect(TLSOptions{CertFile: clientFile, InsecureSkipVerify: true})
+	assertTrue(err == nil, fmt.Sprintf("connect without verifying the server: %v", err), t)
+	if err == nil {
+		conn.Disconnect()
+	}
+
+	bad := map[string]TLSOptions{
+		"unknown authority": TLSOptions{CertFile: clientFile, ServerName: "localhost"},
+		"wrong server name": TLSOptions{CAFile: caFile, CertFile: clientFile, ServerName: "example.com"},
+		"no certificate":    TLSOptions{CAFile: caFile, ServerName: "localhost"},
+		"missing CA file":   TLSOptions{CAFile: filepath.Join(dir, "none.pem"), CertFile: clientFile},
+	}
+	for name, tlsOptions := range bad {
+		conn, err = connect(tlsOptions)
+		assertTrue(err != nil, "connected with "+name, t)
+		if err == nil {
+			conn.Disconnect()
+		}
+	}
+
+	_, err = ConnectByAddrTLS(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, DefaultPoolOptions, &TLSOptions{KeyFile: clientFile, CertFile: filepath.Join(dir, "none.pem")})
+	assertTrue(err != nil, "connected with a missing certificate file", t)
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// Accepts, and never says a word.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			<-done
+			conn.Close()
+		}
+	}()
+
+	options := DefaultPoolOptions
+	options.ConnectTimeout = 50e6
+	start := time.Nanoseconds()
+	_, err = ConnectByAddrTLS(l.Addr().(*net.TCPAddr), options, &TLSOptions{InsecureSkipVerify: true})
+	assertTrue(err != nil, "connected to a server that doesn't handshake", t)
+	assertTrue(time.Nanoseconds()-start < 5e9, "handshake didn't time out", t)
+}
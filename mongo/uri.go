@@ -0,0 +1,412 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+/* MongoDB Connection String URI
+
+http://www.mongodb.org/display/DOCS/Connections
+
+	mongodb://[username:password@]host1[:port1][,host2[:port2],...][/[database][?options]]
+*/
+
+package mongo
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+const _URI_PREFIX = "mongodb://"
+
+/* Settings of a connection, as given by a connection string. */
+type ConnectOptions struct {
+	Hosts    []string // "host:port" of each seed
+	Username string
+	Password string
+	Database string // default database
+
+	AuthSource    string // database holding the credentials; Database if empty
+	AuthMechanism string // one of the Auth* mechanisms; negotiated if empty
+
+	ReplicaSet string
+
+	ReadPreference     string              // one of the Read* modes; ReadPrimary if empty
+	ReadPreferenceTags []map[string]string // tag sets, in order of preference
+	MaxStaleness       int64               // seconds; zero means no limit
+
+	// Write concern.
+	W        int
+	WMode    string // such as "majority"; overrides W if set
+	WTimeout int64  // milliseconds
+	Journal  bool
+	FSync    bool
+
+	// Timeouts in nanoseconds, that override those of Pool when set. The
+	// socket timeout is for both reads and writes.
+	ConnectTimeout int64
+	SocketTimeout  int64
+
+	SSL bool       // secures the sockets with TLS
+	TLS TLSOptions // used if SSL is set
+
+	Pool PoolOptions
+}
+
+/* Parses a connection string into ConnectOptions. Options that are not given
+keep their default values. */
+func ParseURI(uri string) (*ConnectOptions, os.Error) {
+	if !strings.HasPrefix(uri, _URI_PREFIX) {
+		return nil, uriError(uri, "must start with "+_URI_PREFIX)
+	}
+	rest := uri[len(_URI_PREFIX):]
+
+	opts := &ConnectOptions{W: 1, Pool: DefaultPoolOptions}
+
+	var query string
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		db, err := uriUnescape(rest[i+1:])
+		if err != nil {
+			return nil, uriError(uri, err.String())
+		}
+		rest, opts.Database = rest[:i], db
+	}
+
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		userinfo := rest[:i]
+		rest = rest[i+1:]
+
+		user, pass := userinfo, ""
+		j := strings.Index(userinfo, ":")
+		if j >= 0 {
+			user, pass = userinfo[:j], userinfo[j+1:]
+		}
+		var err os.Error
+		if opts.Username, err = uriUnescape(user); err != nil {
+			return nil, uriError(uri, err.String())
+		}
+		if opts.Password, err = uriUnescape(pass); err != nil {
+			return nil, uriError(uri, err.String())
+		}
+		if opts.Username == "" {
+			return nil, uriError(uri, "empty username")
+		}
+	}
+
+	if rest == "" {
+		return nil, uriError(uri, "no hosts")
+	}
+	for _, host := range strings.Split(rest, ",", -1) {
+		if host == "" {
+			return nil, uriError(uri, "empty host")
+		}
+		// The port follows the last ':', unless it is inside the brackets
+		// of an IPv6 address, as in "[::1]:27017".
+		name, port := host, fmt.Sprint(_PORT)
+		if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+			name, port = host[:i], host[i+1:]
+			if _, err := strconv.Atoi(port); err != nil {
+				return nil, uriError(uri, "bad port in "+host)
+			}
+		}
+		bracketed := strings.HasPrefix(name, "[")
+		if bracketed != strings.HasSuffix(name, "]") || (!bracketed && strings.Index(name, ":") >= 0) {
+			return nil, uriError(uri, "bad host "+host)
+		}
+		opts.Hosts = append(opts.Hosts, name+":"+port)
+	}
+
+	if query == "" {
+		return opts, nil
+	}
+	// Both '&' and ';' separate options.
+	for _, pair := range strings.Split(strings.Replace(query, ";", "&", -1), "&", -1) {
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, uriError(uri, "option without value: "+pair)
+		}
+		value, err := uriUnescape(pair[i+1:])
+		if err != nil {
+			return nil, uriError(uri, err.String())
+		}
+		if err = opts.set(pair[:i], value); err != nil {
+			return nil, uriError(uri, err.String())
+		}
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, uriError(uri, err.String())
+	}
+	return opts, nil
+}
+
+/* Sets a single option of a connection string. Names are case insensitive. */
+func (self *ConnectOptions) set(name, value string) (err os.Error) {
+	switch strings.ToLower(name) {
+	case "replicaset":
+		self.ReplicaSet = value
+	case "authsource":
+		self.AuthSource = value
+	case "authmechanism":
+		self.AuthMechanism = value
+
+	case "readpreference":
+		self.ReadPreference = value
+	case "readpreferencetags":
+		tags := make(map[string]string)
+		if value != "" {
+			for _, tag := range strings.Split(value, ",", -1) {
+				i := strings.Index(tag, ":")
+				if i < 0 {
+					return os.NewError("bad read preference tag: " + tag)
+				}
+				tags[tag[:i]] = tag[i+1:]
+			}
+		}
+		self.ReadPreferenceTags = append(self.ReadPreferenceTags, tags)
+	case "maxstalenessseconds":
+		self.MaxStaleness, err = parseUint(name, value)
+
+	case "w":
+		if w, e := strconv.Atoi(value); e == nil && w >= 0 {
+			self.W, self.WMode = w, ""
+		} else {
+			self.WMode = value
+		}
+	case "wtimeoutms":
+		self.WTimeout, err = parseUint(name, value)
+	case "journal", "j":
+		self.Journal, err = parseBool(name, value)
+	case "fsync":
+		self.FSync, err = parseBool(name, value)
+
+	case "connecttimeoutms":
+		var ms int64
+		ms, err = parseUint(name, value)
+		self.ConnectTimeout = ms * 1e6
+	case "sockettimeoutms":
+		var ms int64
+		ms, err = parseUint(name, value)
+		self.SocketTimeout = ms * 1e6
+
+	case "ssl", "tls":
+		self.SSL, err = parseBool(name, value)
+	case "tlscafile", "sslcafile":
+		self.TLS.CAFile = value
+	case "tlscertificatekeyfile", "sslpemkeyfile", "sslclientcertificatekeyfile":
+		self.TLS.CertFile = value
+	case "tlsallowinvalidcertificates", "sslallowinvalidcertificates", "tlsinsecure":
+		self.TLS.InsecureSkipVerify, err = parseBool(name, value)
+
+	case "maxpoolsize":
+		var n int64
+		n, err = parseUint(name, value)
+		self.Pool.MaxSockets = int(n)
+	case "minpoolsize":
+		var n int64
+		n, err = parseUint(name, value)
+		self.Pool.MinSockets = int(n)
+	case "maxidletimems":
+		var ms int64
+		ms, err = parseUint(name, value)
+		self.Pool.MaxIdleTime = ms * 1e6
+
+	default:
+		err = os.NewError("unsupported option " + name)
+	}
+
+	return
+}
+
+/* Gets the credentials of the user, kept in AuthSource, else in the default
+database, else in admin. X.509 users are always in $external. */
+func (self *ConnectOptions) credential() *credential {
+	source := self.AuthSource
+	if source == "" {
+		source = self.Database
+	}
+	if source == "" {
+		source = "admin"
+	}
+	if self.AuthMechanism == AuthMongoX509 {
+		source = "$external"
+	}
+	return &credential{username: self.Username, password: self.Password, source: source, mechanism: self.AuthMechanism}
+}
+
+func (self *ConnectOptions) readPreference() *ReadPreference {
+	return &ReadPreference{self.ReadPreference, self.ReadPreferenceTags, self.MaxStaleness}
+}
+
+func (self *ConnectOptions) validate() os.Error {
+	if err := self.readPreference().validate(); err != nil {
+		return err
+	}
+
+	switch self.AuthMechanism {
+	case "", AuthScramSHA1, AuthScramSHA256, AuthMongoCR:
+	case AuthMongoX509:
+		if !self.SSL {
+			return os.NewError(AuthMongoX509 + " needs TLS")
+		}
+	default:
+		return os.NewError("unsupported authentication mechanism " + self.AuthMechanism)
+	}
+
+	if self.Pool.MaxSockets > 0 && self.Pool.MinSockets > self.Pool.MaxSockets {
+		return os.NewError("minPoolSize is greater than maxPoolSize")
+	}
+	return nil
+}
+
+/* Creates a new connection following a connection string such as
+"mongodb://user:pass@h1:27017,h2/db?replicaSet=rs0&w=majority". */
+func ConnectURI(uri string) (*Connection, os.Error) {
+	opts, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return ConnectWithOptions(opts)
+}
+
+/* Creates a new connection following options. With a ReplicaSet, the hosts
+are the seeds of its discovery; otherwise they are tried in turn and the
+first one that answers is used. */
+func ConnectWithOptions(opts *ConnectOptions) (*Connection, os.Error) {
+	if len(opts.Hosts) == 0 {
+		return nil, os.NewError("no hosts to connect to")
+	}
+
+	newDialer := func(host string) (*dialer, os.Error) {
+		d := &dialer{}
+		if opts.SSL {
+			var err os.Error
+			if d.tls, err = opts.TLS.config(host); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+
+	pool := opts.Pool
+	if opts.ConnectTimeout > 0 {
+		pool.ConnectTimeout = opts.ConnectTimeout
+	}
+	if opts.SocketTimeout > 0 {
+		pool.ReadTimeout, pool.WriteTimeout = opts.SocketTimeout, opts.SocketTimeout
+	}
+
+	var conn *Connection
+	var err os.Error
+	if opts.ReplicaSet != "" {
+		conn, err = connectReplicaSet(opts.ReplicaSet, opts.Hosts, pool, DefaultHeartbeatInterval, newDialer)
+	} else {
+		conn, err = connectFirst(opts.Hosts, pool, newDialer)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.options = opts
+	conn.writeConcern = &WriteConcern{opts.W, opts.WMode, opts.WTimeout, opts.Journal, opts.FSync}
+	conn.readPreference = opts.readPreference()
+	if opts.Username != "" || opts.AuthMechanism == AuthMongoX509 {
+		if err = conn.login(opts.credential()); err != nil {
+			conn.Disconnect()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+/* Gets the host of a "host:port" address, without the brackets of an IPv6
+address. */
+func hostName(addr string) string {
+	return strings.Trim(addr[:strings.LastIndex(addr, ":")], "[]")
+}
+
+/* Connects to the first of hosts that answers. */
+func connectFirst(hosts []string, options PoolOptions, newDialer func(string) (*dialer, os.Error)) (*Connection, os.Error) {
+	var err os.Error
+	for _, host := range hosts {
+		var addr *net.TCPAddr
+		addr, err = net.ResolveTCPAddr(host)
+		if err != nil {
+			continue
+		}
+
+		var d *dialer
+		if d, err = newDialer(hostName(host)); err != nil {
+			// Bad TLS settings are as bad for the other hosts.
+			return nil, err
+		}
+
+		var conn *Connection
+		if conn, err = connectByAddr(addr, options, d); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+
+// === Utility functions
+// ===
+
+func uriError(uri, msg string) os.Error {
+	return os.NewError(fmt.Sprintf("invalid connection string %q: %s", uri, msg))
+}
+
+func parseUint(name, value string) (int64, os.Error) {
+	n, err := strconv.Atoi64(value)
+	if err != nil || n < 0 {
+		return 0, os.NewError(fmt.Sprintf("bad value for %s: %q", name, value))
+	}
+	return n, nil
+}
+
+func parseBool(name, value string) (bool, os.Error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, os.NewError(fmt.Sprintf("bad value for %s: %q", name, value))
+}
+
+/* Decodes the %XX escapes of a connection string. */
+func uriUnescape(s string) (string, os.Error) {
+	if strings.Index(s, "%") < 0 {
+		return s, nil
+	}
+
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", os.NewError("bad escape in " + s)
+		}
+		b, err := strconv.Btoui64(s[i+1:i+3], 16)
+		if err != nil {
+			return "", os.NewError("bad escape in " + s)
+		}
+		out = append(out, byte(b))
+		i += 2
+	}
+	return string(out), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2009-2011 The gomongo Authors.  All rights reserved.
+// Use of this source code is governed by the 3-clause BSD License
+// that can be found in the LICENSE file.
+
+package mongo
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	opts, err := ParseURI("mongodb://user:p%40ss@h1:27018,h2/db?replicaSet=rs0&w=majority&connectTimeoutMS=500" +
+		"&socketTimeoutMS=2000&journal=true&readPreference=secondary&readPreferenceTags=dc:ny,rack:1" +
+		"&readPreferenceTags=&maxPoolSize=10;minPoolSize=2&ssl=true&wtimeoutMS=100")
+	if err != nil {
+		t.Fatalf("cannot parse: %v", err)
+	}
+
+	assertTrue(len(opts.Hosts) == 2, "hosts", t)
+	assertTrue(opts.Hosts[0] == "h1:27018", "explicit port", t)
+	assertTrue(opts.Hosts[1] == "h2:27017", "default port", t)
+	assertTrue(opts.Username == "user" && opts.Password == "p@ss", "credentials", t)
+	assertTrue(opts.Database == "db", "database", t)
+	assertTrue(opts.ReplicaSet == "rs0", "replicaSet", t)
+	assertTrue(opts.WMode == "majority" && opts.WTimeout == 100 && opts.Journal, "write concern", t)
+	assertTrue(opts.ConnectTimeout == 500e6, "connectTimeoutMS", t)
+	assertTrue(opts.SocketTimeout == 2000e6, "socketTimeoutMS", t)
+	assertTrue(opts.ReadPreference == ReadSecondary, "readPreference", t)
+	assertTrue(len(opts.ReadPreferenceTags) == 2, "readPreferenceTags", t)
+	assertTrue(opts.ReadPreferenceTags[0]["dc"] == "ny" && opts.ReadPreferenceTags[0]["rack"] == "1", "tag set", t)
+	assertTrue(len(opts.ReadPreferenceTags[1]) == 0, "empty tag set", t)
+	assertTrue(opts.Pool.MaxSockets == 10 && opts.Pool.MinSockets == 2, "pool", t)
+	assertTrue(opts.SSL, "ssl", t)
+
+	opts, err = ParseURI("mongodb://h1/?tls=true&tlsCAFile=/etc/ca.pem&sslPEMKeyFile=/etc/client.pem" +
+		"&tlsAllowInvalidCertificates=true&authMechanism=MONGODB-X509")
+	assertTrue(err == nil, fmt.Sprintf("cannot parse: %v", err), t)
+	assertTrue(opts.TLS.CAFile == "/etc/ca.pem" && opts.TLS.CertFile == "/etc/client.pem", "TLS files", t)
+	assertTrue(opts.TLS.InsecureSkipVerify, "tlsAllowInvalidCertificates", t)
+	assertTrue(opts.credential().source == "$external", "X.509 users are in $external", t)
+
+	opts, err = ParseURI("mongodb://localhost")
+	assertTrue(err == nil, fmt.Sprintf("cannot parse: %v", err), t)
+	assertTrue(opts.Hosts[0] == "localhost:27017" && opts.Database == "", "minimal URI", t)
+	assertTrue(opts.W == 1 && opts.Pool.MaxSockets == DefaultPoolOptions.MaxSockets, "defaults", t)
+
+	opts, err = ParseURI("mongodb://[::1]:27018,[fe80::1]/db")
+	assertTrue(err == nil, fmt.Sprintf("cannot parse: %v", err), t)
+	assertTrue(len(opts.Hosts) == 2 && opts.Hosts[0] == "[::1]:27018", "IPv6 host with a port", t)
+	assertTrue(opts.Hosts[1] == "[fe80::1]:27017", fmt.Sprintf("IPv6 host with the default port: %v", opts.Hosts), t)
+	assertTrue(hostName(opts.Hosts[0]) == "::1", "IPv6 host name", t)
+}
+
+func TestParseBadURI(t *testing.T) {
+	bad := []string{
+		"http://localhost",
+		"mongodb://",
+		"mongodb://h1,,h2",
+		"mongodb://h1:port",
+		"mongodb://:pass@h1",
+		"mongodb://h1/?w",
+		"mongodb://h1/?unknown=1",
+		"mongodb://h1/?journal=yes",
+		"mongodb://h1/?readPreference=anywhere",
+		"mongodb://h1/?readPreferenceTags=dc:ny",
+		"mongodb://h1/?readPreference=secondary&maxStalenessSeconds=30",
+		"mongodb://h1/?minPoolSize=5&maxPoolSize=2",
+		"mongodb://us%zzer@h1",
+		"mongodb://h1/?authMechanism=PLAIN",
+		"mongodb://::1",
+		"mongodb://[::1:27017",
+		"mongodb://[::1]:port",
+		"mongodb://h1/?authMechanism=MONGODB-X509",
+	}
+	for _, uri := range bad {
+		_, err := ParseURI(uri)
+		assertTrue(err != nil, "accepted "+uri, t)
+	}
+}